@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// apiControl describes a control endpoint of the REST api and the OTGW command it issues
+type apiControl struct {
+	path    string
+	command string
+	isFlag  bool    // the request contains {"enabled": true/false} instead of {"value": 20.5}
+	min     float64 // allowed range of the value
+	max     float64
+}
+
+var apiControls = []apiControl{
+	{path: "room_setpoint/temporary", command: "TT", min: 0, max: 30},
+	{path: "room_setpoint/constant", command: "TC", min: 0, max: 30},
+	{path: "dhw_setpoint", command: "SW", min: 0, max: 90},
+	{path: "max_ch_setpoint", command: "SH", min: 0, max: 90},
+	{path: "outside_temperature", command: "OT", min: -40, max: 64},
+	{path: "ch_enable", command: "CH", isFlag: true},
+	{path: "dhw_enable", command: "HW", isFlag: true},
+}
+
+type apiRequest struct {
+	Value   *float64 `json:"value"`
+	Enabled *bool    `json:"enabled"`
+}
+
+type apiResponse struct {
+	Device   string `json:"device,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type apiServer struct {
+	gateways []*otgwGateway
+	audit    *log.Logger
+	token    string // bearer token required in every request, empty when the api is only reachable locally
+}
+
+// apiBindAddress returns api_http_bind, by default the api only listens on the loopback interface
+func apiBindAddress() string {
+	if bind, ok := config["api_http_bind"]; ok {
+		return bind
+	}
+	return "127.0.0.1"
+}
+
+// checkAPIExposure refuses to serve the api on other interfaces than loopback without a token,
+// anyone on the network could control the heating otherwise. An empty bind address means all interfaces.
+func checkAPIExposure(bind string, token string) error {
+	if ip := net.ParseIP(bind); bind == "localhost" || (ip != nil && ip.IsLoopback()) || len(token) > 0 {
+		return nil
+	}
+	return fmt.Errorf("api_http_bind %q is reachable from the network, set api_token to require a bearer token", bind)
+}
+
+// registerAPI adds the REST api used to control the heating through the gateways to the http server
+func registerAPI(gateways []*otgwGateway) {
+	api := &apiServer{gateways: gateways, token: config["api_token"]}
+	bind := apiBindAddress()
+	if err := checkAPIExposure(bind, api.token); err != nil {
+		log.Println("Not starting the api: ", err)
+		return
+	}
+
+	auditOutput := os.Stdout
+	if len(config["api_audit_log"]) > 0 {
+		f, err := os.OpenFile(config["api_audit_log"], os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Println("Could not open api audit log, logging commands to the console: ", err)
+		} else {
+			auditOutput = f
+		}
+	}
+	api.audit = log.New(auditOutput, "AUDIT ", log.Ldate|log.Ltime)
+
+	for _, control := range apiControls {
+		handleHTTP(bind, config["api_http_port"], "/api/v1/"+control.path, api.controlHandler(control))
+	}
+}
+
+func (api *apiServer) controlHandler(control apiControl) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !api.authorized(r) {
+			api.audit.Printf("client=%s unauthorized request for %s\n", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			api.writeResponse(w, http.StatusUnauthorized, apiResponse{Error: "missing or invalid bearer token"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			api.writeResponse(w, http.StatusMethodNotAllowed, apiResponse{Error: "only POST is supported"})
+			return
+		}
+
+		gw := api.findGateway(r.URL.Query().Get("device"))
+		if gw == nil {
+			api.writeResponse(w, http.StatusNotFound, apiResponse{Error: "unknown device, use ?device=<name> when several gateways are configured"})
+			return
+		}
+
+		var req apiRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req)
+		if err != nil {
+			api.writeResponse(w, http.StatusBadRequest, apiResponse{Device: gw.name, Error: "invalid json: " + err.Error()})
+			return
+		}
+
+		arg, err := control.argument(req)
+		if err != nil {
+			api.writeResponse(w, http.StatusBadRequest, apiResponse{Device: gw.name, Error: err.Error()})
+			return
+		}
+
+		result, err := gw.SendCommand(control.command, arg)
+		command := fmt.Sprintf("%s=%s", control.command, arg)
+		api.logAudit(r, gw, command, result, err)
+
+		if err != nil {
+			api.writeResponse(w, commandErrorStatus(err), apiResponse{Device: gw.name, Command: command, Error: err.Error()})
+			return
+		}
+		api.writeResponse(w, http.StatusOK, apiResponse{Device: gw.name, Command: command, Response: result.Value})
+	}
+}
+
+// argument validates the request and formats it as an argument of the OTGW command
+func (control apiControl) argument(req apiRequest) (string, error) {
+	if control.isFlag {
+		if req.Enabled == nil {
+			return "", fmt.Errorf("%s requires {\"enabled\": true|false}", control.path)
+		}
+		if *req.Enabled {
+			return "1", nil
+		}
+		return "0", nil
+	}
+
+	if req.Value == nil {
+		return "", fmt.Errorf("%s requires {\"value\": <number>}", control.path)
+	}
+	if *req.Value < control.min || *req.Value > control.max {
+		return "", fmt.Errorf("value %.2f for %s is outside the allowed range %.0f .. %.0f", *req.Value, control.path, control.min, control.max)
+	}
+	return fmt.Sprintf("%.2f", *req.Value), nil
+}
+
+// authorized checks the bearer token of a request when api_token is set
+func (api *apiServer) authorized(r *http.Request) bool {
+	if len(api.token) == 0 {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+api.token)) == 1
+}
+
+func (api *apiServer) findGateway(device string) *otgwGateway {
+	if len(device) == 0 {
+		if len(api.gateways) == 1 {
+			return api.gateways[0]
+		}
+		return nil
+	}
+	for _, gw := range api.gateways {
+		if gw.name == device {
+			return gw
+		}
+	}
+	return nil
+}
+
+func (api *apiServer) logAudit(r *http.Request, gw *otgwGateway, command string, result otgwCommandResult, err error) {
+	outcome := "ok " + result.Value
+	if err != nil {
+		outcome = "failed: " + err.Error()
+	}
+	client, _, splitErr := net.SplitHostPort(r.RemoteAddr)
+	if splitErr != nil {
+		client = r.RemoteAddr
+	}
+	api.audit.Printf("client=%s device=%s command=%s result=%s\n", client, gw.label(), command, outcome)
+}
+
+func (api *apiServer) writeResponse(w http.ResponseWriter, status int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// commandErrorStatus maps the errors of SendCommand to http status codes
+func commandErrorStatus(err error) int {
+	switch err.(type) {
+	case *otgwCommandError:
+		return http.StatusUnprocessableEntity
+	}
+	switch err {
+	case errNotConnected:
+		return http.StatusServiceUnavailable
+	case errCommandTimeout:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// apiTimeout is the write timeout of the REST api, long enough for a command with all its retries
+func apiTimeout() time.Duration {
+	return time.Duration(configInt("otgw_command_timeout", 5)*configInt("otgw_command_retries", 3)+5) * time.Second
+}
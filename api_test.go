@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIControl(t *testing.T) {
+
+	testTable := []struct {
+		path   string
+		body   string
+		status int
+		out    string
+	}{
+		{"room_setpoint/temporary", `{"value": 20.5}`, http.StatusOK, `"response":"20.50"`},
+		{"room_setpoint/temporary", `{"value": 45}`, http.StatusBadRequest, "outside the allowed range"},
+		{"ch_enable", `{"value": 1}`, http.StatusBadRequest, "requires"},
+		{"dhw_enable", `{"enabled": false}`, http.StatusOK, `"command":"HW=0"`},
+		{"dhw_setpoint", `{"value": 80}`, http.StatusUnprocessableEntity, "OR"},
+	}
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_discover_identity"] = "NO"
+	config["otgw_command_retries"] = "1"
+
+	addr := startFakeOTGW(t, map[string]string{
+		"TT=20.50": "TT: 20.50",
+		"HW=0":     "HW: 0",
+		"SW=80.00": "OR",
+	})
+	gw := &otgwGateway{address: addr}
+	go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+	waitForConnection(t, gw)
+
+	api := &apiServer{gateways: []*otgwGateway{gw}, audit: logVerbose}
+	for _, test := range testTable {
+		var control apiControl
+		for _, c := range apiControls {
+			if c.path == test.path {
+				control = c
+			}
+		}
+		w := httptest.NewRecorder()
+		api.controlHandler(control)(w, httptest.NewRequest(http.MethodPost, "/api/v1/"+test.path, strings.NewReader(test.body)))
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.out) {
+			t.Errorf("POST %s %s failed: expected %d \"%s\", got %d \"%s\"", test.path, test.body, test.status, test.out, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+
+	testTable := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusNotFound}, // authorized, but there is no gateway
+	}
+	readConfig("otgw2db.testing.cfg")
+
+	api := &apiServer{audit: logVerbose, token: "secret"}
+	for _, test := range testTable {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/"+apiControls[0].path, strings.NewReader("{"))
+		if len(test.header) > 0 {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		api.controlHandler(apiControls[0])(w, r)
+		if w.Code != test.status {
+			t.Errorf("POST with Authorization %q failed: expected %d, got %d \"%s\"", test.header, test.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAPIExposure(t *testing.T) {
+
+	testTable := []struct {
+		bind    string
+		token   string
+		allowed bool
+	}{
+		{"127.0.0.1", "", true},
+		{"::1", "", true},
+		{"localhost", "", true},
+		{"", "", false},
+		{"0.0.0.0", "", false},
+		{"192.168.1.10", "", false},
+		{"", "secret", true},
+	}
+
+	for _, test := range testTable {
+		if err := checkAPIExposure(test.bind, test.token); (err == nil) != test.allowed {
+			t.Errorf("checkAPIExposure(%q, %q) failed: expected allowed %v, got %v", test.bind, test.token, test.allowed, err)
+		}
+	}
+}
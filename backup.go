@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// items that can be read with the PR= command. Only the items with a restore function are settings
+// which can be written back, the others are stored in the backup for reference.
+var backupItems = []struct {
+	item    string
+	name    string
+	restore func(value string) []otgwCommand
+}{
+	{"A", "firmware version", nil},
+	{"B", "build date", nil},
+	{"C", "clock speed", nil},
+	{"M", "operating mode", restoreMode},
+	{"G", "gpio functions", restorePerCharacter("GA", "GB")},
+	{"L", "led functions", restorePerCharacter("LA", "LB", "LC", "LD", "LE", "LF")},
+	{"S", "setback temperature", restoreValue("SB")},
+	{"T", "tweaks", restorePerCharacter("IT", "OH")},
+	{"V", "reference voltage", restoreValue("VR")},
+	{"W", "dhw setting", restoreValue("HW")},
+}
+
+func restoreMode(value string) []otgwCommand {
+	switch value {
+	case "G":
+		return []otgwCommand{{code: "GW", arg: "1"}}
+	case "M":
+		return []otgwCommand{{code: "GW", arg: "0"}}
+	}
+	return nil
+}
+
+// restoreValue restores a setting with a single command taking the reported value
+func restoreValue(code string) func(string) []otgwCommand {
+	return func(value string) []otgwCommand {
+		return []otgwCommand{{code: code, arg: value}}
+	}
+}
+
+// restorePerCharacter restores a setting which is reported as one character per sub-setting, e.g. L=FXOMPC
+func restorePerCharacter(codes ...string) func(string) []otgwCommand {
+	return func(value string) []otgwCommand {
+		var cmds []otgwCommand
+		for i, code := range codes {
+			if i < len(value) {
+				cmds = append(cmds, otgwCommand{code: code, arg: value[i : i+1]})
+			}
+		}
+		return cmds
+	}
+}
+
+// backupSettings reads all items with PR= and writes them to fn in the key = value format of the config file.
+// Items the firmware does not know are skipped, any other error fails the backup and removes the file, so
+// an incomplete backup is not used to restore a replaced PIC.
+func backupSettings(gw *otgwGateway, fn string) error {
+	file, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(file, "# otgw2db backup of otgw %s made at %s\n", gw.label(), time.Now().Format(time.RFC3339))
+	var failures []string
+	read := 0
+	for _, b := range backupItems {
+		value, err := gw.Report(b.item)
+		var cmdErr *otgwCommandError
+		if errors.As(err, &cmdErr) && (cmdErr.Code == "NG" || cmdErr.Code == "BV") {
+			// older firmware does not know every item
+			log.Printf("Could not read %s (PR=%s): %v\n", b.name, b.item, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("Could not read %s (PR=%s): %v\n", b.name, b.item, err)
+			failures = append(failures, b.name)
+			continue
+		}
+		fmt.Fprintf(file, "%s = %s # %s\n", b.item, value, b.name)
+		logVerbose.Printf("Backed up %s: %s\n", b.name, value)
+		read++
+	}
+
+	err = file.Close()
+	if err == nil && len(failures) > 0 {
+		err = fmt.Errorf("could not read %s", strings.Join(failures, ", "))
+	}
+	if err == nil && read == 0 {
+		err = errors.New("the otgw did not report any setting")
+	}
+	if err != nil {
+		os.Remove(fn)
+	}
+	return err
+}
+
+// restoreSettings writes the settings of a backup file back to the gateway and verifies every response
+func restoreSettings(gw *otgwGateway, fn string) error {
+	file, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "#", 2) // split off any comments
+		if strings.Contains(parts[0], "=") {
+			kv := strings.SplitN(parts[0], "=", 2)
+			values[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	var failures int
+	for _, b := range backupItems {
+		value, ok := values[b.item]
+		if !ok || b.restore == nil {
+			continue
+		}
+		for _, cmd := range b.restore(value) {
+			result, err := gw.SendCommand(cmd.code, cmd.arg)
+			if err == nil && !sameValue(result.Value, cmd.arg) {
+				err = fmt.Errorf("otgw responded with %s", result.Value)
+			}
+			if err != nil {
+				log.Printf("Could not restore %s with %s=%s: %v\n", b.name, cmd.code, cmd.arg, err)
+				failures++
+				continue
+			}
+			logVerbose.Printf("Restored %s with %s=%s\n", b.name, cmd.code, cmd.arg)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d settings could not be restored", failures)
+	}
+	return nil
+}
+
+// sameValue compares the value echoed by the gateway with the value sent, numbers may be formatted differently
+func sameValue(a string, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		return fa == fb
+	}
+	return strings.EqualFold(a, b)
+}
+
+// runSettingsCommand handles the backup and restore commands given on the command line
+func runSettingsCommand(command string, fn string, device string) {
+	var gw *otgwGateway
+
+	for _, g := range readGateways() {
+		if g.name == device || (len(device) == 0 && gw == nil) {
+			gw = g
+		}
+	}
+	if gw == nil {
+		log.Fatalf("Unknown OTGW device %s\n", device)
+	}
+
+	config["otgw_discover_identity"] = "NO"
+	go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+	for i := 0; !gw.isConnected(); i++ {
+		if i > 100 {
+			log.Fatalf("Could not connect to otgw %s\n", gw.label())
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	var err error
+	switch command {
+	case "backup":
+		err = backupSettings(gw, fn)
+	case "restore":
+		err = restoreSettings(gw, fn)
+	}
+	if err != nil {
+		log.Fatalf("The %s of otgw %s failed: %v\n", command, gw.label(), err)
+	}
+	log.Printf("The %s of otgw %s using %s was successful\n", command, gw.label(), fn)
+}
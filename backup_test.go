@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startSimulatedOTGW starts a gateway which keeps its settings in state, answers PR= with them and
+// changes them with the setting commands
+func startSimulatedOTGW(t *testing.T, state map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// setting command -> PR item and position of the character in the reported value, -1 for the whole value
+	settings := map[string]struct {
+		item string
+		pos  int
+	}{
+		"GW": {"M", -1}, "GA": {"G", 0}, "GB": {"G", 1}, "SB": {"S", -1}, "IT": {"T", 0}, "OH": {"T", 1},
+		"LA": {"L", 0}, "LB": {"L", 1}, "LC": {"L", 2}, "LD": {"L", 3}, "LE": {"L", 4}, "LF": {"L", 5}, "VR": {"V", -1}, "HW": {"W", -1},
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+			response := "NG"
+			if kv[0] == "PR" {
+				if value, ok := state[kv[1]]; ok {
+					response = fmt.Sprintf("PR: %s=%s", kv[1], value)
+				}
+			} else if s, ok := settings[kv[0]]; ok {
+				value := kv[1]
+				if kv[0] == "GW" {
+					value = map[string]string{"1": "G", "0": "M"}[kv[1]]
+				}
+				if s.pos >= 0 {
+					value = state[s.item][:s.pos] + kv[1] + state[s.item][s.pos+1:]
+				}
+				state[s.item] = value
+				response = fmt.Sprintf("%s: %s", kv[0], kv[1])
+			}
+			conn.Write([]byte(response + "\r\n"))
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestBackupRestore(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_discover_identity"] = "NO"
+	config["otgw_command_retries"] = "1"
+	fn := filepath.Join(t.TempDir(), "otgw.backup")
+
+	original := map[string]string{"A": "OpenTherm Gateway 6.4", "M": "G", "G": "10", "L": "FXOMPC", "S": "16.00", "T": "10", "V": "3", "W": "A"}
+	backupState := make(map[string]string)
+	for k, v := range original {
+		backupState[k] = v
+	}
+	gw := &otgwGateway{address: startSimulatedOTGW(t, backupState)}
+	go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+	waitForConnection(t, gw)
+	if err := backupSettings(gw, fn); err != nil {
+		t.Fatal("backupSettings failed: ", err)
+	}
+	data, _ := os.ReadFile(fn)
+	if !strings.Contains(string(data), "L = FXOMPC") {
+		t.Errorf("backupSettings failed: LED functions missing from backup:\n%s", data)
+	}
+
+	// a replaced PIC with default settings
+	newState := map[string]string{"A": "OpenTherm Gateway 6.5", "M": "M", "G": "00", "L": "FXOMPC", "S": "16.00", "T": "00", "V": "3", "W": "1"}
+	gw = &otgwGateway{address: startSimulatedOTGW(t, newState)}
+	go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+	waitForConnection(t, gw)
+	if err := restoreSettings(gw, fn); err != nil {
+		t.Fatal("restoreSettings failed: ", err)
+	}
+
+	for _, item := range []string{"M", "G", "L", "S", "T", "V", "W"} {
+		if newState[item] != original[item] {
+			t.Errorf("restoreSettings(%s) failed: expected \"%s\", got \"%s\"", item, original[item], newState[item])
+		}
+	}
+	if newState["A"] != "OpenTherm Gateway 6.5" {
+		t.Error("restoreSettings failed: read-only firmware version was changed")
+	}
+}
+
+func TestBackupFailure(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_discover_identity"] = "NO"
+	config["otgw_command_retries"] = "1"
+	config["otgw_command_timeout"] = "1"
+
+	testTable := []struct {
+		state  map[string]string
+		failed bool
+	}{
+		{map[string]string{"A": "OpenTherm Gateway 4.2", "M": "G"}, false}, // older firmware answers NG to the other items
+		{map[string]string{}, true},                                        // every PR= is rejected
+		{nil, true},                                                        // the connection is lost
+	}
+
+	for _, test := range testTable {
+		fn := filepath.Join(t.TempDir(), "otgw.backup")
+		gw := &otgwGateway{address: startSimulatedOTGW(t, test.state)}
+		go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+		waitForConnection(t, gw)
+		if test.state == nil {
+			gw.setConnection(nil)
+		}
+		err := backupSettings(gw, fn)
+		if (err != nil) != test.failed || fileExists(fn) == test.failed {
+			t.Errorf("backupSettings(%v) failed: expected failure %v, got %v", test.state, test.failed, err)
+		}
+	}
+}
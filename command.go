@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// error codes the OTGW returns instead of echoing a command
+var otgwErrorCodes = map[string]string{
+	"NG": "no good, the command code is unknown",
+	"SE": "syntax error, the command was not in the expected format",
+	"BV": "bad value, the value is not allowed for this command",
+	"OR": "out of range, the value is outside the allowed range",
+	"NS": "no space, the table for the command is full",
+	"NF": "not found, the value to be removed is not in the table",
+	"OE": "overrun error, the gateway did not process the command in time",
+}
+
+var errNotConnected = errors.New("there is no connection to the otgw")
+var errCommandTimeout = errors.New("the otgw did not respond to the command in time")
+
+// otgwCommandError is returned when the gateway rejects a command with one of the otgwErrorCodes
+type otgwCommandError struct {
+	Command string
+	Code    string
+}
+
+func (e *otgwCommandError) Error() string {
+	return fmt.Sprintf("otgw rejected command %s: %s (%s)", e.Command, e.Code, otgwErrorCodes[e.Code])
+}
+
+// otgwCommandResult holds the value the gateway echoed back after accepting a command
+type otgwCommandResult struct {
+	Code  string // two letter command code, e.g. TT
+	Value string // the value as echoed by the gateway, e.g. 20.50
+}
+
+func (r otgwCommandResult) Float() (float64, error) {
+	return strconv.ParseFloat(r.Value, 64)
+}
+
+func (r otgwCommandResult) Int() (int, error) {
+	return strconv.Atoi(r.Value)
+}
+
+// otgwCommand is a command that has been written to the gateway and waits for its response
+type otgwCommand struct {
+	code  string
+	arg   string
+	reply chan otgwCommandReply
+}
+
+type otgwCommandReply struct {
+	result otgwCommandResult
+	err    error
+}
+
+func (cmd *otgwCommand) String() string {
+	return fmt.Sprintf("%s=%s", cmd.code, cmd.arg)
+}
+
+// SendCommand writes a command to the gateway and waits for the matching response. Commands that time
+// out are retried up to otgw_command_retries times. Commands are sent one at a time per gateway.
+func (gw *otgwGateway) SendCommand(code string, arg string) (otgwCommandResult, error) {
+	var result otgwCommandResult
+	var err error
+
+	code = strings.ToUpper(code)
+	timeout := time.Duration(configInt("otgw_command_timeout", 5)) * time.Second
+	retries := configInt("otgw_command_retries", 3)
+
+	gw.cmdLock.Lock()
+	defer gw.cmdLock.Unlock()
+
+	for attempt := 1; attempt <= retries; attempt++ {
+		result, err = gw.executeCommand(&otgwCommand{code: code, arg: arg, reply: make(chan otgwCommandReply, 1)}, timeout)
+		if err != errCommandTimeout && err != errNotConnected {
+			break
+		}
+		log.Printf("Command %s=%s to otgw %s failed (attempt %d of %d): %v\n", code, arg, gw.label(), attempt, retries, err)
+		if attempt < retries {
+			time.Sleep(time.Second)
+		}
+	}
+	return result, err
+}
+
+func (gw *otgwGateway) executeCommand(cmd *otgwCommand, timeout time.Duration) (otgwCommandResult, error) {
+	gw.connLock.Lock()
+	conn := gw.conn
+	gw.pending = cmd
+	gw.connLock.Unlock()
+
+	// after a timeout the command is no longer pending, so a response arriving before the retry is written
+	// is dropped. A late response arriving after that is taken for the retry, which sends the same code
+	// and value so the gateway gives the same answer, and the response to the retry itself matches no command.
+	defer func() {
+		gw.connLock.Lock()
+		if gw.pending == cmd {
+			gw.pending = nil
+		}
+		gw.connLock.Unlock()
+	}()
+
+	if conn == nil {
+		return otgwCommandResult{}, errNotConnected
+	}
+
+	logVerbose.Printf("Sending command %v to otgw %s\n", cmd, gw.label())
+	conn.SetWriteDeadline(time.Now().Add(time.Second * 1))
+	_, err := conn.Write([]byte(cmd.String() + "\r\n"))
+	if err != nil {
+		return otgwCommandResult{}, err
+	}
+
+	select {
+	case reply := <-cmd.reply:
+		return reply.result, reply.err
+	case <-time.After(timeout):
+		return otgwCommandResult{}, errCommandTimeout
+	}
+}
+
+// handleResponse checks whether a line received from the gateway is the response to the pending
+// command and delivers it. Returns true if the line was consumed as a response. It is called from the
+// reader of the connection, so it never blocks: the command stops being pending with its first response
+// and a response nobody waits for anymore is dropped.
+func (gw *otgwGateway) handleResponse(msg string) bool {
+	line := strings.TrimSpace(msg)
+
+	gw.connLock.Lock()
+	cmd := gw.pending
+	var reply otgwCommandReply
+	matched := false
+	if cmd != nil {
+		if strings.HasPrefix(line, cmd.code+":") {
+			value := strings.TrimSpace(strings.TrimPrefix(line, cmd.code+":"))
+			reply = otgwCommandReply{result: otgwCommandResult{Code: cmd.code, Value: value}}
+			matched = true
+		} else if _, ok := otgwErrorCodes[line]; ok {
+			reply = otgwCommandReply{err: &otgwCommandError{Command: cmd.String(), Code: line}}
+			matched = true
+		}
+		if matched {
+			gw.pending = nil
+		}
+	}
+	gw.connLock.Unlock()
+
+	if !matched {
+		return false
+	}
+	select {
+	case cmd.reply <- reply:
+	default:
+	}
+	return true
+}
+
+// setConnection registers the connection used to send commands. nil marks the gateway as disconnected
+func (gw *otgwGateway) setConnection(conn net.Conn) {
+	gw.connLock.Lock()
+	gw.conn = conn
+	gw.connLock.Unlock()
+}
+
+func (gw *otgwGateway) sendTemperature(code string, temp float64) (float64, error) {
+	result, err := gw.SendCommand(code, fmt.Sprintf("%.2f", temp))
+	if err != nil {
+		return 0, err
+	}
+	return result.Float()
+}
+
+// SetTemporaryRoomSetpoint overrides the room setpoint until the next program change of the thermostat. 0 cancels the override
+func (gw *otgwGateway) SetTemporaryRoomSetpoint(temp float64) (float64, error) {
+	return gw.sendTemperature("TT", temp)
+}
+
+// SetConstantRoomSetpoint overrides the room setpoint until it is cancelled. 0 cancels the override
+func (gw *otgwGateway) SetConstantRoomSetpoint(temp float64) (float64, error) {
+	return gw.sendTemperature("TC", temp)
+}
+
+// SetOutsideTemperature sets the outside temperature reported to the thermostat
+func (gw *otgwGateway) SetOutsideTemperature(temp float64) (float64, error) {
+	return gw.sendTemperature("OT", temp)
+}
+
+// SetDHWSetpoint sets the domestic hot water setpoint of the boiler
+func (gw *otgwGateway) SetDHWSetpoint(temp float64) (float64, error) {
+	return gw.sendTemperature("SW", temp)
+}
+
+// Report requests a setting or state of the gateway with the PR command, e.g. A for the firmware version
+// The returned value has the "A=" prefix of the response removed.
+func (gw *otgwGateway) Report(item string) (string, error) {
+	item = strings.ToUpper(item)
+	result, err := gw.SendCommand("PR", item)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(result.Value, item+"="), nil
+}
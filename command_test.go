@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeOTGW starts a listener which answers commands like an OTGW using the responses table
+func startFakeOTGW(t *testing.T, responses map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					response, ok := responses[strings.TrimSpace(line)]
+					if !ok {
+						response = "NG"
+					}
+					conn.Write([]byte("T80000200\r\n" + response + "\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func waitForConnection(t *testing.T, gw *otgwGateway) {
+	for i := 0; i < 100; i++ {
+		gw.connLock.Lock()
+		connected := gw.conn != nil
+		gw.connLock.Unlock()
+		if connected {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Fatal("could not connect to the fake otgw")
+}
+
+func TestSendCommand(t *testing.T) {
+
+	testTable := []struct {
+		code  string
+		arg   string
+		value string
+		err   string
+	}{
+		{"TT", "20.50", "20.50", ""},
+		{"PR", "A", "A=OpenTherm Gateway 6.4", ""},
+		{"SW", "90.00", "", "OR"},
+		{"XX", "1", "", "NG"},
+	}
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_discover_identity"] = "NO"
+	config["otgw_command_retries"] = "1"
+
+	addr := startFakeOTGW(t, map[string]string{
+		"TT=20.50": "TT: 20.50",
+		"PR=A":     "PR: A=OpenTherm Gateway 6.4",
+		"SW=90.00": "OR",
+	})
+	gw := &otgwGateway{address: addr}
+	messages := make(chan otgwLine, 10)
+	go readMessagesFromOTGW(gw, messages)
+	waitForConnection(t, gw)
+
+	for _, test := range testTable {
+		result, err := gw.SendCommand(test.code, test.arg)
+		if len(test.err) > 0 {
+			cmdErr, ok := err.(*otgwCommandError)
+			if !ok || cmdErr.Code != test.err {
+				t.Errorf("SendCommand(%s=%s) failed: expected error %s, got %v", test.code, test.arg, test.err, err)
+			}
+		} else if err != nil || result.Value != test.value {
+			t.Errorf("SendCommand(%s=%s) failed: expected \"%s\", got \"%s\" (%v)", test.code, test.arg, test.value, result.Value, err)
+		}
+	}
+}
+
+func TestHandleResponse(t *testing.T) {
+
+	gw := &otgwGateway{}
+	cmd := &otgwCommand{code: "TT", arg: "20.50", reply: make(chan otgwCommandReply, 1)}
+	gw.pending = cmd
+
+	done := make(chan bool)
+	go func() {
+		first := gw.handleResponse("TT: 20.50\r\n")
+		second := gw.handleResponse("TT: 20.50\r\n") // a second response must not block the reader
+		done <- first && !second
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("handleResponse failed: expected only the first response to be consumed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("handleResponse failed: blocked on a second response")
+	}
+	if reply := <-cmd.reply; reply.result.Value != "20.50" {
+		t.Errorf("handleResponse failed: expected 20.50, got %v", reply.result.Value)
+	}
+
+	// a response after the timeout is not delivered to the next command
+	readConfig("otgw2db.testing.cfg")
+	client, server := net.Pipe()
+	defer client.Close()
+	go bufio.NewReader(server).ReadString('\n')
+	gw.setConnection(client)
+	timedOut := &otgwCommand{code: "TT", arg: "21.00", reply: make(chan otgwCommandReply, 1)}
+	if _, err := gw.executeCommand(timedOut, 50*time.Millisecond); err != errCommandTimeout {
+		t.Fatalf("executeCommand failed: expected a timeout, got %v", err)
+	}
+	if gw.handleResponse("TT: 21.00") || len(timedOut.reply) != 0 {
+		t.Error("handleResponse failed: a late response was consumed")
+	}
+}
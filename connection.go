@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// connection states of a gateway as reported in the connection events
+const (
+	connStateConnecting   = "connecting"
+	connStateConnected    = "connected"
+	connStateDisconnected = "disconnected"
+)
+
+// otgwConnStats holds the connection statistics of a gateway
+type otgwConnStats struct {
+	State          string
+	Dials          uint64
+	DialFailures   uint64
+	Disconnects    uint64
+	LinesReceived  uint64
+	Frames         uint64 // valid OpenTherm frames
+	ParseFailures  uint64 // lines that are not a valid OpenTherm frame
+	ReadErrors     uint64
+	ConnectedSince time.Time
+	LastLine       time.Time
+}
+
+// connStats returns a copy of the current connection statistics of the gateway
+func (gw *otgwGateway) connStats() otgwConnStats {
+	gw.statsLock.Lock()
+	defer gw.statsLock.Unlock()
+	return gw.stats
+}
+
+func (gw *otgwGateway) updateStats(update func(stats *otgwConnStats)) {
+	gw.statsLock.Lock()
+	update(&gw.stats)
+	gw.statsLock.Unlock()
+}
+
+// setState records a new connection state and publishes it as an event
+func (gw *otgwGateway) setState(state string, detail string) {
+	gw.updateStats(func(stats *otgwConnStats) {
+		stats.State = state
+		if state == connStateConnected {
+			stats.ConnectedSince = time.Now()
+		}
+	})
+	publishEvent(gw, "connection", state, detail)
+}
+
+// reconnectDelay returns the jittered exponential back-off delay for the given number of failed attempts
+func reconnectDelay(attempt int, maxDelay time.Duration) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+	delay := maxDelay
+	if attempt < 30 && time.Second<<uint(attempt-1) < maxDelay {
+		delay = time.Second << uint(attempt-1)
+	}
+	// pick a random delay between half and the full delay so several processes don't reconnect in lockstep
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// dial opens a connection to the gateway with the configured transport, timeout and tcp keepalive
+func (gw *otgwGateway) dial() (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   time.Duration(gw.settingInt("otgw_dial_timeout", 5)) * time.Second,
+		KeepAlive: time.Duration(gw.settingInt("otgw_keepalive", 30)) * time.Second,
+	}
+	return gw.dialTransport(d)
+}
+
+// readMessagesFromOTGW keeps a connection to the gateway and passes every received line to c. Failed
+// connections are retried forever with a jittered exponential back-off, the program never exits because
+// a gateway is unavailable.
+func readMessagesFromOTGW(gw *otgwGateway, c chan otgwLine) {
+	var connRetryCounter = 0
+
+	maxDelay := time.Duration(gw.settingInt("otgw_reconnect_max_delay", 600)) * time.Second
+
+	for {
+		time.Sleep(reconnectDelay(connRetryCounter, maxDelay))
+
+		gw.setState(connStateConnecting, gw.address)
+		gw.updateStats(func(stats *otgwConnStats) { stats.Dials++ })
+		conn, err := gw.dial()
+
+		if err != nil {
+			connRetryCounter++
+			gw.updateStats(func(stats *otgwConnStats) { stats.DialFailures++ })
+			gw.setState(connStateDisconnected, err.Error())
+			log.Println("Connection to otgw", gw.label(), "could not be established. Attempt ", connRetryCounter, ": ", err)
+			if connRetryCounter == 3 && gw.connStats().ConnectedSince.IsZero() {
+				log.Println("Still no connection to otgw", gw.label(), "Check your settings in otgw2db.cfg, retrying in the background")
+			}
+			continue
+		}
+
+		connRetryCounter = 0
+		log.Println("Succesfully connected to OTGW at: ", conn.RemoteAddr())
+		gw.setConnection(conn)
+		gw.setState(connStateConnected, conn.RemoteAddr().String())
+		if !strings.Contains(gw.setting("otgw_discover_identity"), "NO") {
+			go gw.discoverIdentity()
+		}
+
+		err = gw.readLines(conn, c)
+
+		gw.setConnection(nil)
+		conn.Close()
+		gw.updateStats(func(stats *otgwConnStats) { stats.Disconnects++ })
+		gw.setState(connStateDisconnected, err.Error())
+		stats := gw.connStats()
+		log.Printf("Connection to otgw %s lost: %v (lines received: %d, read errors: %d, disconnects: %d)\n",
+			gw.label(), err, stats.LinesReceived, stats.ReadErrors, stats.Disconnects)
+	}
+}
+
+// readLines reads lines from the connection until it fails. A single reader is kept for the whole
+// connection so no buffered data is lost between reads.
+func (gw *otgwGateway) readLines(conn net.Conn, c chan otgwLine) error {
+	readTimeout := time.Duration(gw.settingInt("otgw_read_timeout", 60)) * time.Second
+	reader := bufio.NewReader(conn)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msgIn, err := reader.ReadString('\n')
+
+		if err != nil {
+			gw.updateStats(func(stats *otgwConnStats) { stats.ReadErrors++ })
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return errors.New("no data received within the read timeout")
+			}
+			if err == io.EOF {
+				return errors.New("connection was closed by the otgw")
+			}
+			return err
+		}
+
+		gw.updateStats(func(stats *otgwConnStats) {
+			stats.LinesReceived++
+			stats.LastLine = time.Now()
+		})
+
+		if gw.handleResponse(msgIn) {
+			continue // responses to our own commands are not passed on
+		}
+		if len(c) == cap(c) {
+			_ = <-c //	dump a value from the channel
+		}
+		c <- otgwLine{gw: gw, msg: msgIn}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+
+	testTable := []struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		{0, 0, 0},
+		{1, 500 * time.Millisecond, time.Second},
+		{4, 4 * time.Second, 8 * time.Second},
+		{20, 5 * time.Minute, 10 * time.Minute},
+		{100, 5 * time.Minute, 10 * time.Minute},
+	}
+
+	for _, test := range testTable {
+		for i := 0; i < 10; i++ {
+			result := reconnectDelay(test.attempt, 10*time.Minute)
+			if result < test.min || result > test.max {
+				t.Errorf("reconnectDelay(%d) failed: expected %v .. %v, got %v", test.attempt, test.min, test.max, result)
+			}
+		}
+	}
+}
+
+func TestReadLines(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_discover_identity"] = "NO"
+	addr := startFakeOTGW(t, map[string]string{})
+	gw := &otgwGateway{address: addr}
+	messages := make(chan otgwLine, 10)
+	go readMessagesFromOTGW(gw, messages)
+	waitForConnection(t, gw)
+
+	// the fake gateway answers every line with a message and an error code in a single write
+	gw.conn.Write([]byte("XX=1\r\n"))
+	select {
+	case line := <-messages:
+		if line.msg != "T80000200\r\n" {
+			t.Errorf("readLines failed: expected \"T80000200\", got \"%s\"", line.msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("readLines failed: no message received")
+	}
+	select {
+	case line := <-messages:
+		if line.msg != "NG\r\n" {
+			t.Errorf("readLines failed: expected \"NG\", got \"%s\"", line.msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("readLines failed: second line of a single packet was lost")
+	}
+	if gw.connStats().State != connStateConnected {
+		t.Errorf("connection state failed: expected %s, got %s", connStateConnected, gw.connStats().State)
+	}
+}
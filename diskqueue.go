@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diskQueue keeps batches of line protocol that could not be written to the database as files in a
+// directory, so they survive a restart of otgw2db and can be replayed in order when the database is back.
+// The file names start with the time the batch was queued, which keeps them sorted.
+type diskQueue struct {
+	dir      string
+	maxBytes int64         // the oldest batches are removed when the queue grows beyond this size
+	maxAge   time.Duration // batches older than this are removed
+	seq      int
+}
+
+const diskQueueExt = ".lp"
+
+func newDiskQueue(dir string, maxBytes int64, maxAge time.Duration) (*diskQueue, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &diskQueue{dir: dir, maxBytes: maxBytes, maxAge: maxAge}, nil
+}
+
+// push stores a batch at the end of the queue
+func (q *diskQueue) push(batch string) error {
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), q.seq%1000000, diskQueueExt)
+
+	// write to a temporary file first so a crash never leaves a partial batch in the queue
+	tmp := filepath.Join(q.dir, name+".tmp")
+	err := os.WriteFile(tmp, []byte(batch), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(q.dir, name))
+	if err != nil {
+		return err
+	}
+	q.enforceLimits()
+	return nil
+}
+
+// files returns the queued batches, oldest first
+func (q *diskQueue) files() []string {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		log.Println("Could not read the write buffer directory: ", err)
+		return nil
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), diskQueueExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// len returns the number of queued batches
+func (q *diskQueue) len() int {
+	return len(q.files())
+}
+
+// queuedAt returns the time a batch was queued from its file name
+func (q *diskQueue) queuedAt(name string) time.Time {
+	nanos, err := strconv.ParseInt(strings.SplitN(name, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// enforceLimits removes the oldest batches when they are older than maxAge or the queue is too large
+func (q *diskQueue) enforceLimits() {
+	names := q.files()
+	sizes := make([]int64, len(names))
+	var total int64
+
+	for i, name := range names {
+		info, err := os.Stat(filepath.Join(q.dir, name))
+		if err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+
+	dropped := 0
+	for i, name := range names {
+		tooOld := q.maxAge > 0 && time.Since(q.queuedAt(name)) > q.maxAge
+		tooLarge := q.maxBytes > 0 && total > q.maxBytes
+		if !tooOld && !tooLarge {
+			break
+		}
+		os.Remove(filepath.Join(q.dir, name))
+		total -= sizes[i]
+		dropped++
+	}
+	if dropped > 0 {
+		log.Printf("Write buffer is full or contains outdated data. Dropped the %d oldest batches\n", dropped)
+	}
+}
+
+// replay sends the queued batches in order and removes every batch that was sent successfully.
+// It stops at the first failure so the order of the data is kept. Returns the number of batches sent.
+func (q *diskQueue) replay(send func(batch string) error) (int, error) {
+	q.enforceLimits()
+
+	sent := 0
+	for _, name := range q.files() {
+		fn := filepath.Join(q.dir, name)
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			return sent, err
+		}
+		err = send(string(data))
+		if err != nil {
+			return sent, err
+		}
+		os.Remove(fn)
+		sent++
+	}
+	return sent, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiskQueue(t *testing.T) {
+
+	dir := t.TempDir()
+	q, err := newDiskQueue(dir, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []string{"batch1\n", "batch2\n", "batch3\n"} {
+		if err := q.push(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the database accepts one batch and then fails again
+	var sent []string
+	n, err := q.replay(func(batch string) error {
+		if len(sent) == 1 {
+			return errors.New("database unavailable")
+		}
+		sent = append(sent, batch)
+		return nil
+	})
+	if n != 1 || err == nil || q.len() != 2 {
+		t.Errorf("replay failed: expected 1 batch sent and 2 left, got %d sent and %d left (%v)", n, q.len(), err)
+	}
+
+	// a restart of otgw2db opens the same directory
+	q, _ = newDiskQueue(dir, 0, time.Hour)
+	n, err = q.replay(func(batch string) error {
+		sent = append(sent, batch)
+		return nil
+	})
+	if n != 2 || err != nil || q.len() != 0 {
+		t.Errorf("replay after restart failed: expected 2 batches sent, got %d (%v)", n, err)
+	}
+	for i, batch := range []string{"batch1\n", "batch2\n", "batch3\n"} {
+		if i >= len(sent) || sent[i] != batch {
+			t.Errorf("replay failed: batches out of order %v", sent)
+			break
+		}
+	}
+}
+
+func TestDiskQueueLimits(t *testing.T) {
+
+	q, _ := newDiskQueue(t.TempDir(), 20, time.Hour)
+	for _, batch := range []string{"0123456789", "abcdefghij", "ABCDEFGHIJ"} {
+		q.push(batch)
+	}
+
+	var sent []string
+	q.replay(func(batch string) error {
+		sent = append(sent, batch)
+		return nil
+	})
+	if len(sent) != 2 || sent[0] != "abcdefghij" {
+		t.Errorf("enforceLimits failed: expected the oldest batch to be dropped, got %v", sent)
+	}
+}
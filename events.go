@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// otgwEvent is a change in the state of a gateway, e.g. a lost connection
+type otgwEvent struct {
+	device string // name of the gateway, empty for a single unnamed gateway
+	name   string // kind of event, e.g. connection
+	state  string // new state, e.g. disconnected
+	detail string
+	time   time.Time
+}
+
+var events = make(chan otgwEvent, 100)
+
+// publishEvent queues an event for the main loop. Events are dropped when the queue is full
+func publishEvent(gw *otgwGateway, name string, state string, detail string) {
+	e := otgwEvent{device: gw.name, name: name, state: state, detail: detail, time: time.Now()}
+	logVerbose.Printf("Event from otgw %s: %s %s (%s)\n", gw.label(), name, state, detail)
+
+	select {
+	case events <- e:
+	default:
+		log.Println("Event queue is full, dropping event:", name, state)
+	}
+}
+
+// DecodeToLineProtocol returns the event as a point in the <influxMeasurementName>_events measurement
+func (e otgwEvent) DecodeToLineProtocol() string {
+	return e.lineProtocolPrecision(time.Second)
+}
+
+// lineProtocolPrecision returns the event in line protocol with the time in the given precision
+func (e otgwEvent) lineProtocolPrecision(precision time.Duration) string {
+	tags := fmt.Sprintf("%s_events,event=%s", config["influxMeasurementName"], escapeTag(e.name))
+	if len(e.device) > 0 {
+		tags += fmt.Sprintf(",device=%s", escapeTag(e.device))
+	}
+	return fmt.Sprintf("%s state=%s,detail=%s %d\n", tags, quoteField(e.state), quoteField(e.detail), lineProtocolTime(e.time, precision))
+}
+
+// escapeTag escapes the characters which have a special meaning in line protocol tags
+func escapeTag(s string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(s)
+}
+
+// quoteField formats a string as a line protocol field value
+func quoteField(s string) string {
+	return fmt.Sprintf("\"%s\"", strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", " ").Replace(s))
+}
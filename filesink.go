@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileSink writes the points to a local file as line protocol (file_format = lp), CSV or JSON Lines.
+// The file is rotated every day (file_rotate_daily) and/or when it grows beyond file_max_mb, rotated
+// files get the time the file was started in their name and can be compressed with gzip.
+type fileSink struct {
+	name     string
+	path     string
+	format   string
+	daily    bool
+	maxBytes int64
+	compress bool
+	maxFiles int
+	columns  []string // field columns of the csv format
+
+	file    *os.File
+	writer  *bufio.Writer
+	csv     *csv.Writer
+	opened  time.Time
+	written int64 // size of the file including the buffered data
+}
+
+// Write adds data to the buffer of the file and counts the size of the file, the csv writer writes to it
+func (s *fileSink) Write(b []byte) (int, error) {
+	n, err := s.writer.Write(b)
+	s.written += int64(n)
+	return n, err
+}
+
+func newFileSink(name string) (sink, error) {
+	s := &fileSink{
+		name:     name,
+		path:     sinkSetting(name, "file_path"),
+		format:   strings.ToLower(sinkSetting(name, "file_format")),
+		daily:    !strings.Contains(sinkSetting(name, "file_rotate_daily"), "NO"),
+		maxBytes: int64(sinkSettingInt(name, "file_max_mb", 0)) * 1024 * 1024,
+		compress: strings.Contains(sinkSetting(name, "file_compress"), "YES"),
+		maxFiles: sinkSettingInt(name, "file_max_files", 0),
+	}
+	if len(s.path) == 0 {
+		return nil, fmt.Errorf("file_path is not set")
+	}
+	switch s.format {
+	case "":
+		s.format = "lp"
+	case "lp", "jsonl":
+	case "csv":
+		s.columns = s.csvColumns()
+	default:
+		return nil, fmt.Errorf("unknown file_format %s, use lp, csv or jsonl", s.format)
+	}
+	return s, s.open()
+}
+
+// csvColumns returns the fields selected for the sink in the order of their data-IDs
+func (s *fileSink) csvColumns() []string {
+	var ids []int
+	for id := range openthermFieldNames {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	var columns []string
+	for _, id := range ids {
+		for _, field := range openthermFieldNames[uint8(id)] {
+			if field != "reserved" && isSinkField(s.name, "", field) {
+				columns = append(columns, field)
+			}
+		}
+	}
+	return columns
+}
+
+func (s *fileSink) csvHeader() []string {
+	return append([]string{"time", "device"}, s.columns...)
+}
+
+// open opens the file for appending. An existing csv file with other columns is rotated first.
+func (s *fileSink) open() error {
+	info, err := os.Stat(s.path)
+	if err == nil && info.Size() > 0 {
+		if s.format == "csv" && !s.sameHeader() {
+			if err := s.rotateFile(info.ModTime()); err != nil {
+				return err
+			}
+			info = nil
+		}
+	} else {
+		info = nil
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.writer = bufio.NewWriter(s.file)
+	s.opened = time.Now()
+	s.written = 0
+	if info != nil {
+		s.opened = info.ModTime()
+		s.written = info.Size()
+	}
+
+	if s.format == "csv" {
+		s.csv = csv.NewWriter(s)
+		if s.written == 0 {
+			s.csv.Write(s.csvHeader())
+			s.csv.Flush()
+		}
+	}
+	return nil
+}
+
+// sameHeader checks if the existing csv file has the current columns
+func (s *fileSink) sameHeader() bool {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header, err := csv.NewReader(f).Read()
+	return err == nil && strings.Join(header, ",") == strings.Join(s.csvHeader(), ",")
+}
+
+// rotate closes the current file, moves it aside and opens a new one. When the file can not be moved
+// the current file is opened again, so writing continues and the rotation is tried again later.
+func (s *fileSink) rotate() error {
+	err := s.closeFile()
+	if rerr := s.rotateFile(s.opened); err == nil {
+		err = rerr
+	}
+	if oerr := s.open(); oerr != nil {
+		return oerr
+	}
+	return err
+}
+
+// rotateFile renames the file at path to <name>-<started><ext>, compresses it and removes the oldest
+// rotated files beyond file_max_files
+func (s *fileSink) rotateFile(started time.Time) error {
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	rotated := fmt.Sprintf("%s-%s%s", base, started.Format("2006-01-02T150405"), ext)
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s-%s-%d%s", base, started.Format("2006-01-02T150405"), i, ext)
+	}
+
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	logVerbose.Printf("Rotated %s to %s\n", s.path, rotated)
+	if s.compress {
+		if err := gzipFile(rotated); err != nil {
+			log.Printf("Could not compress %s: %v\n", rotated, err)
+		}
+	}
+
+	if s.maxFiles > 0 {
+		old := s.rotatedFiles()
+		for len(old) > s.maxFiles {
+			os.Remove(old[0])
+			old = old[1:]
+		}
+	}
+	return nil
+}
+
+// rotatedFiles returns the rotated files of the sink from the oldest to the newest, sorted by the time
+// in their name and the sequence number of files rotated within the same second
+func (s *fileSink) rotatedFiles() []string {
+	ext := filepath.Ext(s.path)
+	base := strings.TrimSuffix(s.path, ext)
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(base)) + `-(\d{4}-\d{2}-\d{2}T\d{6})(?:-(\d+))?` + regexp.QuoteMeta(ext) + `(?:\.gz)?$`)
+
+	type rotated struct {
+		path    string
+		started string
+		seq     int
+	}
+	var files []rotated
+	entries, _ := os.ReadDir(filepath.Dir(s.path))
+	for _, entry := range entries {
+		if m := pattern.FindStringSubmatch(entry.Name()); m != nil {
+			seq, _ := strconv.Atoi(m[2])
+			files = append(files, rotated{filepath.Join(filepath.Dir(s.path), entry.Name()), m[1], seq})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].started != files[j].started {
+			return files[i].started < files[j].started
+		}
+		return files[i].seq < files[j].seq
+	})
+
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+func fileExists(fn string) bool {
+	_, err := os.Stat(fn)
+	return err == nil
+}
+
+// gzipFile compresses fn to fn.gz and removes fn
+func gzipFile(fn string) error {
+	in, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(fn + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn + ".gz")
+		return err
+	}
+	return os.Remove(fn)
+}
+
+// checkRotation rotates the file when the day has changed or the file is too large, and opens the file
+// again when that failed before
+func (s *fileSink) checkRotation(now time.Time) error {
+	if s.file == nil {
+		return s.open()
+	}
+	newDay := s.daily && now.Format("2006-01-02") != s.opened.Format("2006-01-02")
+	tooLarge := s.maxBytes > 0 && s.written >= s.maxBytes
+	if (newDay || tooLarge) && s.written > 0 {
+		return s.rotate()
+	}
+	return nil
+}
+
+// write adds b to the file, also when the rotation failed but the file could be opened again
+func (s *fileSink) write(b []byte) error {
+	err := s.checkRotation(time.Now())
+	if s.file == nil {
+		return err
+	}
+	if _, werr := s.Write(b); werr != nil {
+		err = werr
+	}
+	return err
+}
+
+func (s *fileSink) writePoint(p otgwPoint) error {
+	switch s.format {
+	case "csv":
+		return s.writeCSV(p)
+	case "jsonl":
+		fields := make(map[string]interface{})
+		for _, f := range p.fields {
+			if value, err := f.float(); err == nil {
+				fields[f.name] = value
+			} else {
+				fields[f.name] = f.value
+			}
+		}
+		return s.writeJSON(map[string]interface{}{
+			"time":        p.time.Format(time.RFC3339Nano),
+			"measurement": p.measurement,
+			"device":      p.device,
+			"data_id":     p.msgID,
+			"tags":        p.tags,
+			"fields":      fields,
+		})
+	}
+	return s.write([]byte(p.lineProtocol()))
+}
+
+func (s *fileSink) writeCSV(p otgwPoint) error {
+	values := make(map[string]string)
+	for _, f := range p.fields {
+		values[f.name] = f.value
+	}
+	row := []string{p.time.Format(time.RFC3339), p.device}
+	found := false
+	for _, column := range s.columns {
+		value, ok := values[column]
+		found = found || ok
+		row = append(row, value)
+	}
+	if !found {
+		return nil
+	}
+
+	err := s.checkRotation(time.Now())
+	if s.file == nil {
+		return err
+	}
+	s.csv.Write(row)
+	s.csv.Flush()
+	if werr := s.csv.Error(); werr != nil {
+		err = werr
+	}
+	return err
+}
+
+func (s *fileSink) writeJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.write(append(b, '\n'))
+}
+
+// writeEvent writes the events in the line protocol and JSON Lines formats, they do not fit in the csv columns
+func (s *fileSink) writeEvent(e otgwEvent) error {
+	switch s.format {
+	case "lp":
+		return s.write([]byte(e.DecodeToLineProtocol()))
+	case "jsonl":
+		return s.writeJSON(map[string]interface{}{
+			"time":   e.time.Format(time.RFC3339Nano),
+			"device": e.device,
+			"event":  e.name,
+			"state":  e.state,
+			"detail": e.detail,
+		})
+	}
+	return nil
+}
+
+// flush writes the buffered data to the file every second and rotates the file at midnight
+func (s *fileSink) flush(now time.Time) error {
+	if s.file == nil {
+		return s.open()
+	}
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	return s.checkRotation(now)
+}
+
+func (s *fileSink) closeFile() error {
+	err := s.writer.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+	return err
+}
+
+func (s *fileSink) close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.closeFile()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSink(t *testing.T) {
+
+	testTable := []struct {
+		format  string
+		maxMB   string
+		content string
+	}{
+		{"lp", "0", "otgw,device=home boiler_water_temp=60.20 1700000000\n"},
+		{"csv", "0", "time,device,boiler_water_temp\n2023-11-14T22:13:20Z,home,60.20\n"},
+		{"jsonl", "0", `{"data_id":25,"device":"home","fields":{"boiler_water_temp":60.2},"measurement":"otgw","tags":null,"time":"2023-11-14T22:13:20Z"}` + "\n"},
+	}
+
+	for _, test := range testTable {
+		readConfig("otgw2db.testing.cfg")
+		for key := range config {
+			if strings.HasPrefix(key, "store_") {
+				config[key] = "NO"
+			}
+		}
+		config["store_boiler_water_temp"] = "YES"
+		config["file_path"] = filepath.Join(t.TempDir(), "otgw."+test.format)
+		config["file_format"] = test.format
+
+		s, err := newFileSink("file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ot := openthermMessage{device: "home"}
+		ot.ParseMessage("B40193C33")
+		point, _ := ot.DecodeToPoint()
+		point.time = time.Unix(1700000000, 0).UTC()
+		s.writePoint(point)
+		s.close()
+
+		content, _ := os.ReadFile(config["file_path"])
+		if string(content) != test.content {
+			t.Errorf("file sink %s failed: expected %q, got %q", test.format, test.content, content)
+		}
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	dir := t.TempDir()
+	config["file_path"] = filepath.Join(dir, "otgw.lp")
+	config["file_max_mb"] = "1"
+	config["file_compress"] = "YES"
+	config["file_max_files"] = "2"
+	os.WriteFile(filepath.Join(dir, "otgw-2000-01-01T000000.lp.gz"), nil, 0644) // oldest rotated file
+	os.WriteFile(filepath.Join(dir, "otgw-other.lp"), nil, 0644)                // not a rotated file
+
+	s, err := newFileSink("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := openthermMessage{}
+	ot.ParseMessage("B40193C33")
+	point, _ := ot.DecodeToPoint()
+	line := point.lineProtocol()
+	lines := 3*1024*1024/len(line) + 1 // enough for three rotations
+	for i := 0; i < lines; i++ {
+		s.writePoint(point)
+	}
+	s.close()
+
+	rotated := s.(*fileSink).rotatedFiles()
+	if len(rotated) != 2 || !fileExists(filepath.Join(dir, "otgw-other.lp")) || fileExists(filepath.Join(dir, "otgw-2000-01-01T000000.lp.gz")) {
+		t.Fatalf("file rotation failed: expected 2 compressed files and otgw-other.lp, got %v", rotated)
+	}
+	f, _ := os.Open(rotated[1])
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(zr)
+	if len(content) < 1024*1024 || !strings.HasPrefix(string(content), line) {
+		t.Errorf("file rotation failed: unexpected content of %d bytes in %s", len(content), rotated[1])
+	}
+}
+
+func TestRotatedFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	names := []string{
+		"otgw-2024-01-01T000000-2.lp",
+		"otgw-2024-01-01T000000.lp.gz",
+		"otgw-2023-12-31T235959.lp.gz",
+		"otgw-2024-01-01T000000-10.lp.gz",
+		"otgw-2024-01-01T000000-1.lp.gz",
+		"otgw-other.lp",
+		"otgw-2024-01-01T000000.csv",
+		"otgw.lp",
+	}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+
+	s := &fileSink{path: filepath.Join(dir, "otgw.lp")}
+	var rotated []string
+	for _, path := range s.rotatedFiles() {
+		rotated = append(rotated, filepath.Base(path))
+	}
+	expected := "otgw-2023-12-31T235959.lp.gz otgw-2024-01-01T000000.lp.gz otgw-2024-01-01T000000-1.lp.gz otgw-2024-01-01T000000-2.lp otgw-2024-01-01T000000-10.lp.gz"
+	if strings.Join(rotated, " ") != expected {
+		t.Errorf("rotatedFiles failed: expected %s, got %s", expected, strings.Join(rotated, " "))
+	}
+}
+
+func TestFileRotationFailure(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	dir := filepath.Join(t.TempDir(), "data")
+	os.Mkdir(dir, 0755)
+	config["file_path"] = filepath.Join(dir, "otgw.lp")
+
+	s, err := newFileSink("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := openthermMessage{}
+	ot.ParseMessage("B40193C33")
+	point, _ := ot.DecodeToPoint()
+	s.writePoint(point)
+
+	// the rotation at midnight fails while the directory is gone
+	s.(*fileSink).opened = time.Now().AddDate(0, 0, -1)
+	os.RemoveAll(dir)
+	if err := s.writePoint(point); err == nil {
+		t.Error("file rotation failed: expected an error without the directory")
+	}
+
+	// the sink opens the file again when the directory is back
+	os.Mkdir(dir, 0755)
+	if err := s.writePoint(point); err != nil {
+		t.Errorf("file rotation failed: the sink did not recover: %v", err)
+	}
+	s.close()
+	content, _ := os.ReadFile(config["file_path"])
+	if string(content) != point.lineProtocol() {
+		t.Errorf("file rotation failed: expected %q after recovering, got %q", point.lineProtocol(), content)
+	}
+}
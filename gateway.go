@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otgwGateway holds the settings and the decoder state of a single OTGW connection
+type otgwGateway struct {
+	name    string // device name as used in the config file and the device tag. Empty for a single unnamed gateway
+	address string
+	OT      openthermMessage
+
+	connLock sync.Mutex   // protects conn and pending
+	conn     net.Conn     // current connection, nil when disconnected
+	pending  *otgwCommand // command waiting for a response
+	cmdLock  sync.Mutex   // makes sure only one command at a time is sent to the gateway
+
+	statsLock sync.Mutex // protects stats
+	stats     otgwConnStats
+
+	watchdog busWatchdog
+
+	identityLock sync.Mutex        // protects identity
+	identity     map[string]string // firmware version and settings of the gateway, see discoverIdentity
+
+	valuesLock sync.Mutex // protects values
+	values     map[string]fieldValue
+}
+
+// fieldValue is the last decoded value of a field
+type fieldValue struct {
+	otgwField
+	msgID    uint8
+	received time.Time
+}
+
+// otgwLine is a single line received from a gateway
+type otgwLine struct {
+	gw  *otgwGateway
+	msg string
+}
+
+// readGateways builds the list of gateways from the config. When OTGWdevices is set every
+// named device needs its own <name>.OTGWaddress setting, otherwise the single OTGWaddress is used.
+func readGateways() []*otgwGateway {
+	var gateways []*otgwGateway
+
+	if len(config["OTGWdevices"]) == 0 {
+		gw := &otgwGateway{address: config["OTGWaddress"]}
+		gateways = append(gateways, gw)
+		return gateways
+	}
+
+	for _, name := range strings.Split(config["OTGWdevices"], ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		address := config[fmt.Sprintf("%s.OTGWaddress", name)]
+		if len(address) == 0 {
+			log.Fatalf("No address configured for OTGW device %s. Please add %s.OTGWaddress to otgw2db.cfg\n", name, name)
+		}
+		gw := &otgwGateway{name: name, address: address}
+		gw.OT.device = name
+		gateways = append(gateways, gw)
+	}
+
+	if len(gateways) == 0 {
+		log.Fatal("OTGWdevices does not contain any device names. Check your settings in otgw2db.cfg\n")
+	}
+	return gateways
+}
+
+// label returns a short description of the gateway for use in log messages
+func (gw *otgwGateway) label() string {
+	if len(gw.name) > 0 {
+		return fmt.Sprintf("%s (%s)", gw.name, gw.address)
+	}
+	return gw.address
+}
+
+// setting returns the value of key for this gateway. See deviceSetting.
+func (gw *otgwGateway) setting(key string) string {
+	return deviceSetting(gw.name, key)
+}
+
+// settingInt returns the integer value of key for this gateway or def if it is missing or not a number
+func (gw *otgwGateway) settingInt(key string, def int) int {
+	val, err := strconv.Atoi(gw.setting(key))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// isConnected reports whether there currently is a connection to the gateway
+func (gw *otgwGateway) isConnected() bool {
+	gw.connLock.Lock()
+	defer gw.connLock.Unlock()
+	return gw.conn != nil
+}
+
+// recordValues stores the decoded values of the current message of the gateway
+func (gw *otgwGateway) recordValues() {
+	point, ok := gw.OT.DecodeToPoint()
+	if !ok {
+		return
+	}
+
+	gw.valuesLock.Lock()
+	defer gw.valuesLock.Unlock()
+	if gw.values == nil {
+		gw.values = make(map[string]fieldValue)
+	}
+	for _, f := range point.fields {
+		gw.values[f.name] = fieldValue{otgwField: f, msgID: point.msgID, received: point.time}
+	}
+}
+
+// latestValues returns a copy of the last decoded value of every field
+func (gw *otgwGateway) latestValues() map[string]fieldValue {
+	gw.valuesLock.Lock()
+	defer gw.valuesLock.Unlock()
+
+	values := make(map[string]fieldValue, len(gw.values))
+	for field, v := range gw.values {
+		values[field] = v
+	}
+	return values
+}
+
+// latestValue returns the last decoded value of a field if it was received within maxAge
+func (gw *otgwGateway) latestValue(field string, maxAge time.Duration) (string, bool) {
+	gw.valuesLock.Lock()
+	defer gw.valuesLock.Unlock()
+	v, ok := gw.values[field]
+	if !ok || time.Since(v.received) > maxAge {
+		return "", false
+	}
+	return v.value, true
+}
+
+// deviceSetting returns the value of <device>.<key> if it is set in the config and falls back to
+// the global value of key otherwise. This allows per device overrides of e.g. the store_ settings.
+func deviceSetting(device string, key string) string {
+	if len(device) > 0 {
+		if val, ok := config[fmt.Sprintf("%s.%s", device, key)]; ok {
+			return val
+		}
+	}
+	return config[key]
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// characters which are replaced by an underscore in the parts of a metric path
+var graphiteInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// graphiteSink sends every numeric field as a metric in the Graphite plaintext protocol (graphite sink)
+// or as a StatsD gauge (statsd sink). The metric path is built with a template like
+// heating.{device}.{field}, the settings of a statsd sink start with statsd_ instead of graphite_.
+type graphiteSink struct {
+	name      string
+	statsd    bool
+	template  string
+	prefix    string
+	maxPacket int
+	writer    *socketWriter
+}
+
+func newGraphiteSink(name string) (sink, error) {
+	return newMetricPathSink(name, "graphite", "tcp")
+}
+
+func newStatsDSink(name string) (sink, error) {
+	return newMetricPathSink(name, "statsd", "udp")
+}
+
+func newMetricPathSink(name string, kind string, protocol string) (sink, error) {
+	address := sinkSetting(name, kind+"_address")
+	if len(address) == 0 {
+		return nil, fmt.Errorf("%s_address is not set", kind)
+	}
+	if len(sinkSetting(name, kind+"_protocol")) > 0 {
+		protocol = sinkSetting(name, kind+"_protocol")
+	}
+	writer, err := newSocketWriter(protocol, address, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &graphiteSink{
+		name:      name,
+		statsd:    kind == "statsd",
+		template:  sinkSetting(name, kind+"_template"),
+		prefix:    sinkSetting(name, kind+"_prefix"),
+		maxPacket: sinkSettingInt(name, kind+"_max_packet", 1432),
+		writer:    writer,
+	}
+	if len(s.template) == 0 {
+		s.template = "{prefix}.{device}.{field}"
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = "otgw"
+	}
+	if strings.Contains(s.path(otgwPoint{}, ""), "{") {
+		return nil, fmt.Errorf("unknown placeholder in %s_template %s, use {prefix}, {measurement}, {device}, {field} and {data_id}", kind, s.template)
+	}
+	return s, nil
+}
+
+// path returns the metric path of a field. Empty parts are left out, so the template
+// {prefix}.{device}.{field} gives otgw.boiler_water_temp for a gateway without a device name.
+func (s *graphiteSink) path(p otgwPoint, field string) string {
+	clean := func(part string) string { return graphiteInvalidChars.ReplaceAllString(part, "_") }
+	path := strings.NewReplacer(
+		"{prefix}", s.prefix,
+		"{measurement}", clean(p.measurement),
+		"{device}", clean(p.device),
+		"{field}", clean(field),
+		"{data_id}", strconv.Itoa(int(p.msgID)),
+	).Replace(s.template)
+
+	var parts []string
+	for _, part := range strings.Split(path, ".") {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (s *graphiteSink) writePoint(p otgwPoint) error {
+	var lines []string
+	for _, f := range p.fields {
+		value, err := f.float()
+		if err != nil || f.name == "reserved" {
+			continue
+		}
+		path := s.path(p, f.name)
+		formatted := strconv.FormatFloat(value, 'f', -1, 64)
+		switch {
+		case !s.statsd:
+			lines = append(lines, fmt.Sprintf("%s %s %d\n", path, formatted, p.time.Unix()))
+		case value < 0:
+			// a gauge with a sign is a change of the gauge in statsd, set it to 0 first
+			lines = append(lines, fmt.Sprintf("%s:0|g\n%s:%s|g\n", path, path, formatted))
+		default:
+			lines = append(lines, fmt.Sprintf("%s:%s|g\n", path, formatted))
+		}
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return s.writer.writeLines(lines, s.maxPacket)
+}
+
+// writeEvent does nothing, the events have no numeric value to send
+func (s *graphiteSink) writeEvent(e otgwEvent) error {
+	return nil
+}
+
+func (s *graphiteSink) close() error {
+	s.writer.close()
+	return nil
+}
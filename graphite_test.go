@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSink(t *testing.T) {
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := tcp.Accept()
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+
+	readConfig("otgw2db.testing.cfg")
+	config["graphite_address"] = tcp.Addr().String()
+	config["graphite_template"] = "heating.{device}.{field}"
+	config["statsd_address"] = udp.LocalAddr().String()
+	config["statsd_max_packet"] = "100"
+
+	graphite, err := newGraphiteSink("graphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsd, err := newStatsDSink("statsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	for _, device := range []string{"home", ""} {
+		ot := openthermMessage{device: device}
+		for _, msg := range []string{"B40193C33", "B401EFFF8"} {
+			ot.ParseMessage(msg)
+			point, _ := ot.DecodeToPoint()
+			point.time = now
+			graphite.writePoint(point)
+			statsd.writePoint(point)
+		}
+	}
+	graphite.close()
+	statsd.close()
+
+	testTable := []string{
+		"heating.home.boiler_water_temp 60.2 1700000000",
+		"heating.home.solar_collector_temperature -8 1700000000",
+		"heating.boiler_water_temp 60.2 1700000000",
+		"heating.solar_collector_temperature -8 1700000000",
+	}
+	for _, expected := range testTable {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("graphite sink failed: expected %s, got %s", expected, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("graphite sink failed: no line for %s", expected)
+		}
+	}
+
+	var received []string
+	buf := make([]byte, 1500)
+	for len(received) < 3 {
+		udp.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := udp.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("statsd sink failed: %v", err)
+		}
+		if n > 100 {
+			t.Errorf("statsd sink failed: packet of %d bytes", n)
+		}
+		received = append(received, string(buf[:n]))
+	}
+	expected := "otgw.home.boiler_water_temp:60.2|g\n"
+	if received[0] != expected {
+		t.Errorf("statsd sink failed: expected %q, got %q", expected, received[0])
+	}
+	expected = "otgw.home.solar_collector_temperature:0|g\notgw.home.solar_collector_temperature:-8|g\n"
+	if received[1] != expected {
+		t.Errorf("statsd sink failed: expected %q, got %q", expected, received[1])
+	}
+	if !strings.HasPrefix(received[2], "otgw.boiler_water_temp:") {
+		t.Errorf("statsd sink failed: expected the path without device, got %q", received[2])
+	}
+}
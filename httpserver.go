@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// http handlers are registered per port so the api, health and metrics endpoints can share a port
+var httpMuxes = make(map[string]*http.ServeMux)
+
+// address the server of a port listens on, all interfaces when it is not set
+var httpBinds = make(map[string]string)
+
+// handleHTTP registers a handler on the http server for port. A bind address limits the server to one
+// interface, the endpoints which share the port are then only available on that interface too.
+func handleHTTP(bind string, port string, pattern string, handler http.HandlerFunc) {
+	mux, ok := httpMuxes[port]
+	if !ok {
+		mux = http.NewServeMux()
+		httpMuxes[port] = mux
+	}
+	if len(bind) > 0 {
+		httpBinds[port] = bind
+	}
+	mux.HandleFunc(pattern, handler)
+}
+
+// startHTTPServers starts a server for every port with registered handlers
+func startHTTPServers() {
+	for port, mux := range httpMuxes {
+		server := &http.Server{
+			Addr:         net.JoinHostPort(httpBinds[port], port),
+			Handler:      mux,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: apiTimeout(),
+		}
+		go func(port string) {
+			log.Printf("Starting http server on %s\n", server.Addr)
+			err := server.ListenAndServe()
+			if err != nil {
+				log.Println("Http server on port", port, "stopped: ", err)
+			}
+		}(port)
+	}
+}
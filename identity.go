@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// gateway settings queried with PR= after every connect, with the name used for the metadata
+var identityItems = []struct {
+	item string
+	name string
+}{
+	{"A", "firmware"},
+	{"M", "mode"},
+	{"G", "gpio_functions"},
+	{"L", "led_functions"},
+	{"S", "setback_temperature"},
+}
+
+// discoverIdentity queries the firmware version and settings of the gateway and logs any changes
+// compared to the previous connection. Called in its own goroutine after each successful connect.
+func (gw *otgwGateway) discoverIdentity() {
+	identity := make(map[string]string)
+
+	for _, it := range identityItems {
+		value, err := gw.Report(it.item)
+		if err != nil {
+			log.Printf("Could not query %s of otgw %s: %v\n", it.name, gw.label(), err)
+			continue
+		}
+		identity[it.name] = normaliseIdentity(it.name, value)
+	}
+
+	gw.identityLock.Lock()
+	previous := gw.identity
+	gw.identity = identity
+	gw.identityLock.Unlock()
+
+	var names []string
+	for name := range identity {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if previous == nil {
+			log.Printf("OTGW %s %s: %s\n", gw.label(), name, identity[name])
+		} else if previous[name] != identity[name] {
+			log.Printf("OTGW %s %s changed from %s to %s\n", gw.label(), name, previous[name], identity[name])
+		} else {
+			continue
+		}
+		publishEvent(gw, "identity", identity[name], name)
+	}
+}
+
+// normaliseIdentity turns the raw PR= values into something usable as a tag
+func normaliseIdentity(name string, value string) string {
+	switch name {
+	case "firmware":
+		// "OpenTherm Gateway 6.4" -> "6.4"
+		fields := strings.Fields(value)
+		if len(fields) > 0 {
+			return fields[len(fields)-1]
+		}
+	case "mode":
+		switch value {
+		case "G":
+			return "gateway"
+		case "M":
+			return "monitor"
+		}
+	}
+	return value
+}
+
+// identityValue returns a single item of the gateway identity, empty when it is not known
+func (gw *otgwGateway) identityValue(name string) string {
+	gw.identityLock.Lock()
+	defer gw.identityLock.Unlock()
+	return gw.identity[name]
+}
+
+// identityTags returns the identity items selected with tag_firmware and tag_mode as tags
+func (gw *otgwGateway) identityTags() map[string]string {
+	tags := make(map[string]string)
+
+	for _, name := range []string{"firmware", "mode"} {
+		value := gw.identityValue(name)
+		if strings.Contains(gw.setting(fmt.Sprintf("tag_%s", name)), "YES") && len(value) > 0 {
+			tags["otgw_"+name] = value
+		}
+	}
+	return tags
+}
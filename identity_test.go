@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiscoverIdentity(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["otgw_command_retries"] = "1"
+	config["tag_firmware"] = "YES"
+	config["tag_mode"] = "YES"
+
+	addr := startFakeOTGW(t, map[string]string{
+		"PR=A": "PR: A=OpenTherm Gateway 6.4",
+		"PR=M": "PR: M=M",
+		"PR=G": "PR: G=10",
+		"PR=L": "PR: L=FXOMPC",
+		"PR=S": "PR: S=16.00",
+	})
+	gw := &otgwGateway{address: addr}
+	go readMessagesFromOTGW(gw, make(chan otgwLine, 10))
+	waitForConnection(t, gw)
+	gw.discoverIdentity()
+
+	testTable := []struct {
+		name string
+		out  string
+	}{
+		{"firmware", "6.4"},
+		{"mode", "monitor"},
+		{"gpio_functions", "10"},
+		{"led_functions", "FXOMPC"},
+		{"setback_temperature", "16.00"},
+	}
+
+	for _, test := range testTable {
+		result := gw.identityValue(test.name)
+		if result != test.out {
+			t.Errorf("discoverIdentity(%s) failed: expected \"%s\", got \"%s\"", test.name, test.out, result)
+		}
+	}
+
+	gw.OT.tags = gw.identityTags()
+	gw.OT.ParseMessage("B40193C33")
+	result := gw.OT.DecodeToLineProtocol()
+	if !strings.HasPrefix(result, "otgw,otgw_firmware=6.4,otgw_mode=monitor boiler_water_temp=60.20") {
+		t.Errorf("identityTags failed: got \"%s\"", result)
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// influxSink writes the points and events to influxdb. The batches are collected and sent by the
+// goroutine of sendToInfluxBuffer, all settings are read with sinkSetting so several influx sinks can
+// write to different databases.
+type influxSink struct {
+	name   string
+	client *http.Client // shared by all requests of the sink, so connections are kept alive between batches
+	queue  *diskQueue   // write buffer of influx_buffer_dir, nil when it is not configured
+	dir    string       // influx_buffer_dir claimed by the sink, see claimWriteBuffer
+
+	out  chan string
+	stop chan struct{}
+	done chan struct{}
+
+	buffer        string // line protocol of the current batch
+	bufferCount   int
+	pointsWritten int
+}
+
+// newInfluxWriter creates the sink with its http client, without connecting to influxdb
+func newInfluxWriter(name string) (*influxSink, error) {
+	s := &influxSink{name: name, out: make(chan string, 1000), stop: make(chan struct{}), done: make(chan struct{})}
+
+	tlsConfig, err := buildTLSConfig(s.setting("influxTLSCA"), s.setting("influxTLSCert"), s.setting("influxTLSKey"),
+		strings.Contains(s.setting("influxTLSInsecure"), "YES"))
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{
+		Timeout: time.Duration(sinkSettingInt(name, "influx_timeout", 30)) * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     5 * time.Minute,
+		},
+	}
+	return s, nil
+}
+
+func (s *influxSink) setting(key string) string {
+	return sinkSetting(s.name, key)
+}
+
+// version returns the selected write api: 1 for /write, 2 (default) for /api/v2/write
+func (s *influxSink) version() int {
+	return sinkSettingInt(s.name, "influxVersion", 2)
+}
+
+// baseURL returns influxURL without a trailing slash, which may include a path prefix when influxdb
+// is behind a reverse proxy (e.g. https://example.com/influx). Without influxURL http://influxIP:influxPort is used.
+func (s *influxSink) baseURL() string {
+	if len(s.setting("influxURL")) > 0 {
+		return strings.TrimRight(s.setting("influxURL"), "/")
+	}
+	return fmt.Sprintf("http://%s:%s", s.setting("influxIP"), s.setting("influxPort"))
+}
+
+// requestBody returns the body of a write request, gzip compressed when influxGzip = YES
+func (s *influxSink) requestBody(postBody string) (io.Reader, bool, error) {
+	if !strings.Contains(s.setting("influxGzip"), "YES") {
+		return strings.NewReader(postBody), false, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte(postBody))
+	if err == nil {
+		err = zw.Close()
+	}
+	return &buf, true, err
+}
+
+// writeURL returns the write endpoint with its query parameters for the selected api version
+//   - v1: /write?db=<influxDatabase>&rp=<influxRetentionPolicy>, influxBucket is used when influxDatabase is not set
+//   - v2: /api/v2/write?org=<influxOrg>&bucket=<influxBucket>
+func (s *influxSink) writeURL() string {
+	params := url.Values{}
+	params.Set("precision", "s")
+
+	if s.version() == 1 {
+		db := s.setting("influxDatabase")
+		if len(db) == 0 {
+			db = s.setting("influxBucket")
+		}
+		params.Set("db", db)
+		if len(s.setting("influxRetentionPolicy")) > 0 {
+			params.Set("rp", s.setting("influxRetentionPolicy"))
+		}
+		if strings.Contains(s.setting("influxAuthParams"), "YES") {
+			params.Set("u", s.setting("influxUser"))
+			params.Set("p", s.setting("influxPass"))
+		}
+		return fmt.Sprintf("%s/write?%s", s.baseURL(), params.Encode())
+	}
+
+	if len(s.setting("influxOrg")) > 0 {
+		params.Set("org", s.setting("influxOrg"))
+	}
+	params.Set("bucket", s.setting("influxBucket"))
+	return fmt.Sprintf("%s/api/v2/write?%s", s.baseURL(), params.Encode())
+}
+
+// setAuth adds the authentication header for the selected api version. v1 uses basic auth
+// (unless influxAuthParams = YES), v2 uses a token. Without influxToken the v2 api is given the
+// user:pass token which InfluxDB 1.8 accepts on its v2 compatibility endpoint.
+func (s *influxSink) setAuth(req *http.Request) {
+	if s.version() == 1 {
+		if len(s.setting("influxUser")) > 0 && !strings.Contains(s.setting("influxAuthParams"), "YES") {
+			req.SetBasicAuth(s.setting("influxUser"), s.setting("influxPass"))
+		}
+		return
+	}
+
+	token := s.setting("influxToken")
+	if len(token) == 0 && len(s.setting("influxUser")) > 0 {
+		token = fmt.Sprintf("%s:%s", s.setting("influxUser"), s.setting("influxPass"))
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+}
+
+// write buffer directories by the name of the influx sink using them
+var influxBufferDirs = make(map[string]string)
+var influxBufferDirsLock sync.Mutex
+
+// claimWriteBuffer reserves influx_buffer_dir for the sink. Two sinks with the same directory would send
+// each other's batches to the wrong database, so this fails when another influx sink already uses it.
+func (s *influxSink) claimWriteBuffer() error {
+	dir := s.setting("influx_buffer_dir")
+	if len(dir) == 0 {
+		return nil
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	influxBufferDirsLock.Lock()
+	defer influxBufferDirsLock.Unlock()
+	if other, ok := influxBufferDirs[dir]; ok && other != s.name {
+		return fmt.Errorf("influx_buffer_dir %s is already used by sink %s, set %s.influx_buffer_dir to a directory of its own", dir, other, s.name)
+	}
+	influxBufferDirs[dir] = s.name
+	s.dir = dir
+	return nil
+}
+
+// releaseWriteBuffer frees the directory claimed with claimWriteBuffer
+func (s *influxSink) releaseWriteBuffer() {
+	influxBufferDirsLock.Lock()
+	defer influxBufferDirsLock.Unlock()
+	if len(s.dir) > 0 && influxBufferDirs[s.dir] == s.name {
+		delete(influxBufferDirs, s.dir)
+	}
+}
+
+// openWriteBuffer opens the on-disk write buffer set with influx_buffer_dir, nil when it is not configured
+func (s *influxSink) openWriteBuffer() *diskQueue {
+	if len(s.setting("influx_buffer_dir")) == 0 {
+		return nil
+	}
+	q, err := newDiskQueue(s.setting("influx_buffer_dir"),
+		int64(sinkSettingInt(s.name, "influx_buffer_max_mb", 100))*1024*1024,
+		time.Duration(sinkSettingInt(s.name, "influx_buffer_max_age", 168))*time.Hour)
+	if err != nil {
+		log.Println("Could not open the write buffer, data points will be dropped when influxdb is not available: ", err)
+		return nil
+	}
+	if n := q.len(); n > 0 {
+		log.Printf("Write buffer contains %d batches from a previous run, they will be sent when influxdb is available\n", n)
+	}
+	return q
+}
+
+func newInfluxSink(name string) (sink, error) {
+	s, err := newInfluxWriter(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.claimWriteBuffer(); err != nil {
+		return nil, err
+	}
+	if !s.test() {
+		if len(s.setting("influx_buffer_dir")) == 0 {
+			return nil, errors.New("could not connect to influxdb. Please check the settings in otgw2db.cfg")
+		}
+		// the write buffer keeps the data until influxdb is available
+		log.Printf("Could not connect to influxdb, storing the data in %s until it is available\n", s.setting("influx_buffer_dir"))
+	}
+	go s.sendToInfluxBuffer()
+	return s, nil
+}
+
+func (s *influxSink) writePoint(p otgwPoint) error {
+	queueLineProtocol(s.out, p.lineProtocol())
+	return nil
+}
+
+func (s *influxSink) writeEvent(e otgwEvent) error {
+	queueLineProtocol(s.out, e.DecodeToLineProtocol())
+	return nil
+}
+
+func (s *influxSink) close() error {
+	close(s.stop)
+	<-s.done
+	s.releaseWriteBuffer()
+	return nil
+}
+
+// sendToInfluxBuffer collects the line protocol in batches. A batch is sent when it contains
+// influx_batch_size points, when adding a point would make it larger than influx_batch_max_bytes or when
+// its oldest point has waited influx_flush_interval seconds. When stop is closed the points still in the
+// channel and the buffer are flushed and done is closed.
+func (s *influxSink) sendToInfluxBuffer() {
+	batchSize := sinkSettingInt(s.name, "influx_batch_size", 20)
+	maxBytes := sinkSettingInt(s.name, "influx_batch_max_bytes", 1024*1024)
+	flushInterval := time.Duration(sinkSettingInt(s.name, "influx_flush_interval", 10)) * time.Second
+
+	s.queue = s.openWriteBuffer()
+	flushTicker := time.NewTicker(time.Second)
+	replayTicker := time.NewTicker(30 * time.Second)
+	var batchStarted time.Time
+
+	addPoint := func(lp string) {
+		if s.bufferCount > 0 && len(s.buffer)+len(lp) > maxBytes {
+			s.flushInfluxBuffer()
+		}
+		if s.bufferCount == 0 {
+			batchStarted = time.Now()
+		}
+		s.buffer += lp
+		s.bufferCount++
+		logVerbose.Print("Added message ", s.bufferCount, " to the buffer:", lp)
+		if s.bufferCount >= batchSize {
+			s.flushInfluxBuffer()
+		}
+	}
+
+	for {
+		select {
+		case lp := <-s.out:
+			addPoint(lp)
+		case <-flushTicker.C:
+			if s.bufferCount > 0 && time.Since(batchStarted) >= flushInterval {
+				s.flushInfluxBuffer()
+			}
+		case <-replayTicker.C:
+			s.replayWriteBuffer()
+		case <-s.stop:
+			for len(s.out) > 0 {
+				addPoint(<-s.out)
+			}
+			if s.bufferCount > 0 {
+				log.Printf("Flushing %d points to influxdb before exiting\n", s.bufferCount)
+				s.flushInfluxBuffer()
+			}
+			close(s.done)
+			return
+		}
+	}
+}
+
+// flushInfluxBuffer sends the current batch. When that fails the batch is stored in the write buffer
+// (if configured) or dropped.
+func (s *influxSink) flushInfluxBuffer() {
+	var err error
+	if s.queue != nil && s.queue.len() > 0 {
+		err = errors.New("older batches are waiting in the write buffer") // keep the data in order
+	} else {
+		err = s.sendWithRetry(s.buffer)
+	}
+
+	if err == nil {
+		s.pointsWritten += s.bufferCount
+		logVerbose.Printf("Submitted %v points to influxdb. total points written: %v\n", s.bufferCount, s.pointsWritten)
+	} else if isPermanentInfluxError(err) {
+		log.Println("Influxdb rejected the data points, dropping them: ", err)
+	} else if s.queue == nil {
+		log.Println("Could not submit data to influxdb. Dropping data points")
+	} else if qErr := s.queue.push(s.buffer); qErr != nil {
+		log.Println("Could not submit data to influxdb or store it in the write buffer. Dropping data points: ", qErr)
+	} else {
+		// sent again by the replay every 30 seconds, not right away to the server which just failed
+		logVerbose.Printf("Stored %v points in the write buffer: %v\n", s.bufferCount, err)
+	}
+	s.buffer = ""
+	s.bufferCount = 0
+}
+
+// replayWriteBuffer sends the batches waiting in the write buffer
+func (s *influxSink) replayWriteBuffer() {
+	if s.queue == nil || s.queue.len() == 0 {
+		return
+	}
+	sent, err := s.queue.replay(func(batch string) error {
+		err := s.sendWithRetry(batch)
+		if isPermanentInfluxError(err) {
+			log.Println("Influxdb rejected a batch from the write buffer, dropping it: ", err)
+			return nil
+		}
+		return err
+	})
+	if sent > 0 {
+		log.Printf("Sent %d batches from the write buffer to influxdb, %d batches left\n", sent, s.queue.len())
+	}
+	if err != nil {
+		logVerbose.Println("Write buffer replay stopped: ", err)
+	}
+}
+
+// send writes a batch to influxdb once
+func (s *influxSink) send(postBody string) error {
+	body, compressed, err := s.requestBody(postBody)
+	if err != nil {
+		log.Println("Compressing the batch failed: ", err.Error())
+		return err
+	}
+	req, err := http.NewRequest("POST", s.writeURL(), body)
+	if err != nil {
+		log.Println("Creating http request failed: ", err.Error())
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	s.setAuth(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		countInfluxError(influxErrorNetwork)
+		log.Printf("Http POST to influxdb failed: %v (errors so far: %s)\n", err, influxErrorSummary())
+		return err
+	}
+
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body) // read the body completely so the connection can be reused
+
+	if resp.StatusCode != 204 {
+		writeErr := parseInfluxError(resp)
+		countInfluxError(writeErr.Kind)
+		log.Printf("Http POST to influxdb returned status: %s %s (errors so far: %s)\n", resp.Status, writeErr.Message, influxErrorSummary())
+		return writeErr
+	}
+	return nil
+}
+
+// sendWithRetry sends a batch and retries up to influx_retries times on network errors and
+// on the statuses that indicate a temporary problem (429 and 5xx). The delay between attempts doubles
+// every time, a Retry-After header of the server is honoured up to influx_retry_max_delay seconds.
+// Lines the database can not parse are removed and the rest of the batch is sent again, points dropped
+// by the database in a partial write are not retried.
+func (s *influxSink) sendWithRetry(postBody string) error {
+	retries := sinkSettingInt(s.name, "influx_retries", 3)
+	maxDelay := time.Duration(sinkSettingInt(s.name, "influx_retry_max_delay", 60)) * time.Second
+	delay := time.Second
+
+	for attempt := 1; ; attempt++ {
+		err := s.send(postBody)
+		if err == nil {
+			return nil
+		}
+
+		var writeErr *influxWriteError
+		isWriteErr := errors.As(err, &writeErr)
+		if isWriteErr {
+			switch writeErr.Kind {
+			case influxErrorPartialWrite, influxErrorFieldConflict:
+				// the database stored the other points, sending the batch again would fail the same way
+				log.Println("Influxdb dropped points from the batch: ", writeErr.Message)
+				return nil
+			case influxErrorParse:
+				remaining, dropped := removeLines(postBody, writeErr.Lines, writeErr.Unparsed)
+				if dropped > 0 && len(remaining) > 0 {
+					log.Printf("Removed %d lines influxdb could not parse, sending the rest of the batch again\n", dropped)
+					postBody = remaining
+					continue
+				}
+			}
+		}
+
+		if (isWriteErr && !writeErr.retryable()) || attempt > retries {
+			return err
+		}
+
+		wait := delay
+		if isWriteErr && writeErr.RetryAfter > 0 {
+			wait = writeErr.RetryAfter
+		}
+		if wait > maxDelay {
+			wait = maxDelay
+		}
+		log.Printf("Retrying write to influxdb in %v (attempt %d of %d)\n", wait, attempt, retries)
+		time.Sleep(wait)
+		delay *= 2
+	}
+}
+
+// parseRetryAfter parses a Retry-After header which holds either a number of seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// test checks whether the database is reachable using /ping (v1) or /health (v2)
+func (s *influxSink) test() bool {
+
+	endpoint := "/health"
+	if s.version() == 1 {
+		endpoint = "/ping"
+	}
+
+	req, err := http.NewRequest("GET", s.baseURL()+endpoint, nil)
+	if err != nil {
+		log.Println("Influxdb test error: ", err)
+		return false
+	}
+	s.setAuth(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Println("Influxdb test error: ", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		log.Println("Influxdb test error: ", endpoint, "returned status", resp.Status)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFakeInflux starts a server recording the requests it receives, it answers writes with status
+func startFakeInflux(t *testing.T, status int, requests chan *http.Request) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests != nil {
+			requests <- r
+		}
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config["influxIP"] = host
+	config["influxPort"] = port
+}
+
+func TestInfluxVersions(t *testing.T) {
+
+	testTable := []struct {
+		settings map[string]string
+		path     string
+		query    string
+		auth     string
+		ping     string
+	}{
+		{map[string]string{"influxVersion": "1", "influxDatabase": "heating", "influxRetentionPolicy": "autogen"},
+			"/write", "db=heating&precision=s&rp=autogen", "Basic dXNlcjpwYXNz", "/ping"},
+		{map[string]string{"influxVersion": "1", "influxAuthParams": "YES"},
+			"/write", "db=bucket&p=pass&precision=s&u=user", "", "/ping"},
+		{map[string]string{"influxVersion": "2", "influxOrg": "home", "influxToken": "secret"},
+			"/api/v2/write", "bucket=bucket&org=home&precision=s", "Token secret", "/health"},
+		{map[string]string{},
+			"/api/v2/write", "bucket=bucket&precision=s", "Token user:pass", "/health"},
+	}
+
+	for _, test := range testTable {
+		readConfig("otgw2db.testing.cfg")
+		config["influxBucket"] = "bucket"
+		config["influxUser"] = "user"
+		config["influxPass"] = "pass"
+		for k, v := range test.settings {
+			config[k] = v
+		}
+		requests := make(chan *http.Request, 10)
+		startFakeInflux(t, http.StatusNoContent, requests)
+		s, err := newInfluxWriter("influx")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !s.test() {
+			t.Errorf("test(%v) failed", test.settings)
+		}
+		if r := <-requests; r.URL.Path != test.ping {
+			t.Errorf("test(%v) failed: expected %s, got %s", test.settings, test.ping, r.URL.Path)
+		}
+
+		err = s.send("otgw room_temperature=20.50\n")
+		r := <-requests
+		if err != nil || r.URL.Path != test.path || r.URL.RawQuery != test.query || r.Header.Get("Authorization") != test.auth {
+			t.Errorf("send(%v) failed: got %s?%s with \"%s\" (%v)", test.settings, r.URL.Path, r.URL.RawQuery, r.Header.Get("Authorization"), err)
+		}
+		if strings.Contains(r.Header.Get("Authentication"), "Token") {
+			t.Errorf("send(%v) failed: still sends the Authentication header", test.settings)
+		}
+	}
+}
+
+func TestInfluxRetry(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["influx_retries"] = "3"
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config["influxIP"] = host
+	config["influxPort"] = port
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = s.sendWithRetry("otgw room_temperature=20.50\n")
+	if err != nil || attempts != 3 {
+		t.Errorf("sendWithRetry failed: expected success after 3 attempts, got %d attempts (%v)", attempts, err)
+	}
+	if time.Since(start) < 2*time.Second {
+		t.Errorf("sendWithRetry failed: did not wait before retrying")
+	}
+
+	// a rejected batch is not retried
+	attempts = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	err = s.sendWithRetry("otgw room_temperature=\n")
+	if err == nil || attempts != 1 {
+		t.Errorf("sendWithRetry failed: expected 1 attempt for status 400, got %d (%v)", attempts, err)
+	}
+}
+
+func TestInfluxBatching(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["influx_batch_size"] = "100"
+	config["influx_flush_interval"] = "1"
+	requests := make(chan *http.Request, 10)
+	startFakeInflux(t, http.StatusNoContent, requests)
+
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.sendToInfluxBuffer()
+
+	// a single point is sent after the flush interval
+	s.out <- "otgw room_temperature=20.50\n"
+	select {
+	case <-requests:
+	case <-time.After(3 * time.Second):
+		t.Error("sendToInfluxBuffer failed: batch was not flushed after the flush interval")
+	}
+
+	// the remaining points are sent when stopping
+	s.out <- "otgw room_temperature=20.75\n"
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("sendToInfluxBuffer failed: did not stop")
+	}
+	select {
+	case <-requests:
+	default:
+		t.Error("sendToInfluxBuffer failed: no final flush when stopping")
+	}
+}
+
+func TestInfluxHTTPSGzip(t *testing.T) {
+
+	var bodies []string
+	var paths []string
+	var newConns int
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err == nil {
+				data, _ := io.ReadAll(zr)
+				bodies = append(bodies, string(data))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns++
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	readConfig("otgw2db.testing.cfg")
+	config["influxURL"] = server.URL + "/influx/"
+	config["influxTLSInsecure"] = "YES"
+	config["influxGzip"] = "YES"
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.send("otgw room_temperature=20.50\n"); err != nil {
+			t.Fatal("send failed: ", err)
+		}
+	}
+	if len(paths) != 3 || paths[0] != "/influx/api/v2/write" {
+		t.Errorf("send failed: expected path /influx/api/v2/write, got %v", paths)
+	}
+	if len(bodies) != 3 || bodies[0] != "otgw room_temperature=20.50\n" {
+		t.Errorf("send failed: body not gzip compressed, got %q", bodies)
+	}
+	if newConns != 1 {
+		t.Errorf("send failed: expected the connection to be reused, got %d connections", newConns)
+	}
+}
+
+func TestInfluxSinks(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["influx_batch_size"] = "1"
+	var urls []string
+	requests := make(map[string]chan *http.Request)
+	for _, name := range []string{"home", "cabin"} {
+		requests[name] = make(chan *http.Request, 10)
+		startFakeInflux(t, http.StatusNoContent, requests[name])
+		config[name+".influxURL"] = "http://" + config["influxIP"] + ":" + config["influxPort"]
+		config[name+".influxBucket"] = name
+		urls = append(urls, config[name+".influxURL"])
+	}
+	if urls[0] == urls[1] {
+		t.Fatal("influx sinks failed: the servers have the same address")
+	}
+
+	// two sinks of the type influx each write to their own database with their own batch
+	for _, name := range []string{"home", "cabin"} {
+		s, err := newInfluxSink(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-requests[name] // health check
+		s.writePoint(otgwPoint{measurement: "otgw", device: name, time: time.Now(), fields: []otgwField{{name: "room_temperature", value: "20.50"}}})
+		s.close()
+	}
+	for _, name := range []string{"home", "cabin"} {
+		select {
+		case r := <-requests[name]:
+			if r.URL.Query().Get("bucket") != name {
+				t.Errorf("influx sinks failed: %s wrote to bucket %s", name, r.URL.Query().Get("bucket"))
+			}
+		case <-time.After(time.Second):
+			t.Errorf("influx sinks failed: nothing written by %s", name)
+		}
+	}
+}
+
+func TestInfluxStartWithoutServer(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close() // nothing is listening on this port
+	config["influxIP"] = host
+	config["influxPort"] = port
+	config["influx_retries"] = "0"
+
+	if _, err := newInfluxSink("influx"); err == nil {
+		t.Error("newInfluxSink failed: expected an error without influxdb and write buffer")
+	}
+
+	// with a write buffer the sink starts and stores the data on disk
+	config["influx_buffer_dir"] = t.TempDir()
+	s, err := newInfluxSink("influx")
+	if err != nil {
+		t.Fatalf("newInfluxSink failed: %v", err)
+	}
+	s.writePoint(otgwPoint{measurement: "otgw", time: time.Now(), fields: []otgwField{{name: "room_temperature", value: "20.50"}}})
+	s.close()
+
+	q, err := newDiskQueue(config["influx_buffer_dir"], 1024*1024, time.Hour)
+	if err != nil || q.len() != 1 {
+		t.Errorf("newInfluxSink failed: expected 1 batch in the write buffer (%v)", err)
+	}
+}
+
+func TestInfluxWriteBufferPerSink(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close() // the sinks start with their write buffer
+	config["influxIP"] = host
+	config["influxPort"] = port
+	config["influx_retries"] = "0"
+	config["influx_buffer_dir"] = t.TempDir()
+
+	s, err := newInfluxSink("influx")
+	if err != nil {
+		t.Fatalf("newInfluxSink failed: %v", err)
+	}
+	defer s.close()
+
+	if _, err := newInfluxSink("archive"); err == nil {
+		t.Error("newInfluxSink failed: expected an error for a second sink with the same influx_buffer_dir")
+	}
+	config["archive.influx_buffer_dir"] = t.TempDir()
+	archive, err := newInfluxSink("archive")
+	if err != nil {
+		t.Fatalf("newInfluxSink failed with a write buffer of its own: %v", err)
+	}
+	archive.close()
+}
+
+func TestInfluxInvalidTLS(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["influx_buffer_dir"] = t.TempDir()
+	config["influxTLSCA"] = filepath.Join(t.TempDir(), "missing-ca.pem")
+	if _, err := newInfluxSink("influx"); err == nil {
+		t.Error("newInfluxSink failed: expected an error for a tls ca which does not exist")
+	}
+}
+
+func TestInfluxFlushToWriteBuffer(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	config["influxURL"] = server.URL
+	config["influx_retries"] = "0"
+	config["influx_buffer_dir"] = t.TempDir()
+
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.queue = s.openWriteBuffer()
+	s.buffer = "otgw room_temperature=20.50\n"
+	s.bufferCount = 1
+	s.flushInfluxBuffer()
+
+	// the failed batch is stored without sending it again right away
+	if requests != 1 || s.queue.len() != 1 {
+		t.Errorf("flushInfluxBuffer failed: expected 1 request and 1 stored batch, got %d requests and %d batches", requests, s.queue.len())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kinds of write errors, also used as the names of the error counters
+const (
+	influxErrorAuth          = "auth"
+	influxErrorRateLimit     = "rate_limit"
+	influxErrorPartialWrite  = "partial_write"
+	influxErrorFieldConflict = "field_type_conflict"
+	influxErrorParse         = "parse"
+	influxErrorServer        = "server"
+	influxErrorNetwork       = "network"
+	influxErrorOther         = "other"
+)
+
+// influxWriteError is returned when influxdb answers a write with an unexpected status
+type influxWriteError struct {
+	StatusCode int
+	Status     string
+	Kind       string        // one of the influxError constants
+	Message    string        // error message of the database
+	Lines      []int         // lines of the batch (starting at 1) the database could not parse
+	Unparsed   []string      // lines quoted by the database as unparsable
+	RetryAfter time.Duration // value of the Retry-After header, 0 when absent
+}
+
+func (e *influxWriteError) Error() string {
+	if e.Kind == influxErrorAuth {
+		return fmt.Sprintf("Database refused the credentials (status %s). Check settings", e.Status)
+	}
+	return fmt.Sprintf("Database does not accept data (status %s): %s", e.Status, e.Message)
+}
+
+// retryable reports whether the write may succeed when it is sent again later
+func (e *influxWriteError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// isPermanentInfluxError reports whether a batch will never be accepted, so there is no point in
+// keeping it. Authentication errors are not permanent as the credentials can be fixed.
+func isPermanentInfluxError(err error) bool {
+	var writeErr *influxWriteError
+	return errors.As(err, &writeErr) && !writeErr.retryable() && writeErr.Kind != influxErrorAuth
+}
+
+// influxErrorBody covers the error responses of both api versions: v1 uses "error", v2 "code",
+// "message" and for parse errors "line"
+type influxErrorBody struct {
+	Error   string `json:"error"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line"`
+}
+
+var influxLineNumber = regexp.MustCompile(`line (\d+)`)
+var influxUnparsedLine = regexp.MustCompile(`unable to parse '([^']*)'`)
+
+// parseInfluxError reads the error response of a write and classifies it
+func parseInfluxError(resp *http.Response) *influxWriteError {
+	writeErr := &influxWriteError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var body influxErrorBody
+	if json.Unmarshal(data, &body) == nil {
+		writeErr.Message = body.Message
+		if len(body.Error) > 0 {
+			writeErr.Message = body.Error
+		}
+	} else {
+		writeErr.Message = strings.TrimSpace(string(data))
+	}
+	if body.Line > 0 {
+		writeErr.Lines = append(writeErr.Lines, body.Line)
+	}
+	for _, m := range influxLineNumber.FindAllStringSubmatch(writeErr.Message, -1) {
+		n, _ := strconv.Atoi(m[1])
+		writeErr.Lines = append(writeErr.Lines, n)
+	}
+	for _, m := range influxUnparsedLine.FindAllStringSubmatch(writeErr.Message, -1) {
+		writeErr.Unparsed = append(writeErr.Unparsed, m[1])
+	}
+
+	msg := strings.ToLower(writeErr.Message)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		writeErr.Kind = influxErrorAuth
+	case resp.StatusCode == http.StatusTooManyRequests:
+		writeErr.Kind = influxErrorRateLimit
+	case resp.StatusCode >= 500:
+		writeErr.Kind = influxErrorServer
+	case strings.Contains(msg, "field type conflict"):
+		writeErr.Kind = influxErrorFieldConflict
+	case strings.Contains(msg, "partial write"):
+		// influxdb 1.x stored the lines it could parse, e.g. "partial write: unable to parse ..."
+		writeErr.Kind = influxErrorPartialWrite
+	case strings.Contains(msg, "unable to parse") || strings.Contains(msg, "failed to parse"):
+		writeErr.Kind = influxErrorParse
+	default:
+		writeErr.Kind = influxErrorOther
+	}
+	return writeErr
+}
+
+// removeLines removes the lines with the given numbers (starting at 1) from a batch, and any line the
+// database quoted in an "unable to parse" message. Returns the remaining batch and the number of lines removed.
+func removeLines(batch string, numbers []int, unparsed []string) (string, int) {
+	bad := make(map[int]bool)
+	for _, n := range numbers {
+		bad[n] = true
+	}
+	quoted := make(map[string]bool)
+	for _, line := range unparsed {
+		quoted[strings.TrimSpace(line)] = true
+	}
+
+	var kept []string
+	dropped := 0
+	for i, line := range strings.Split(strings.TrimSuffix(batch, "\n"), "\n") {
+		if bad[i+1] || quoted[strings.TrimSpace(line)] {
+			dropped++
+			logVerbose.Println("Dropping line influxdb could not parse: ", line)
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		return "", dropped
+	}
+	return strings.Join(kept, "\n") + "\n", dropped
+}
+
+var influxErrorCounts = make(map[string]int)
+var influxErrorCountsLock sync.Mutex
+
+// countInfluxError increments the counter of a kind of write error
+func countInfluxError(kind string) {
+	influxErrorCountsLock.Lock()
+	influxErrorCounts[kind]++
+	influxErrorCountsLock.Unlock()
+}
+
+// influxErrorSummary returns the error counters as "kind=count" pairs for logging
+func influxErrorSummary() string {
+	influxErrorCountsLock.Lock()
+	defer influxErrorCountsLock.Unlock()
+
+	var parts []string
+	for kind, count := range influxErrorCounts {
+		parts = append(parts, fmt.Sprintf("%s=%d", kind, count))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseInfluxError(t *testing.T) {
+
+	testTable := []struct {
+		status int
+		body   string
+		kind   string
+		lines  []int
+	}{
+		{401, `{"code":"unauthorized","message":"unauthorized access"}`, influxErrorAuth, nil},
+		{429, ``, influxErrorRateLimit, nil},
+		{503, `{"error":"timeout"}`, influxErrorServer, nil},
+		{400, `{"error":"partial write: field type conflict: input field \"room_setpoint\" on measurement \"otgw\" is type integer, already exists as type float dropped=1"}`, influxErrorFieldConflict, nil},
+		{400, `{"code":"invalid","message":"failed to parse line protocol: errors encountered on line(s):\nline 2: invalid field format","line":2}`, influxErrorParse, []int{2, 2}},
+		{400, `{"error":"partial write: points beyond retention policy dropped=3"}`, influxErrorPartialWrite, nil},
+		{400, `{"error":"partial write: unable to parse 'otgw bad=': missing field value dropped=1"}`, influxErrorPartialWrite, nil},
+	}
+
+	for _, test := range testTable {
+		resp := &http.Response{StatusCode: test.status, Status: http.StatusText(test.status), Header: http.Header{}, Body: io.NopCloser(strings.NewReader(test.body))}
+		result := parseInfluxError(resp)
+		if result.Kind != test.kind || len(result.Lines) != len(test.lines) {
+			t.Errorf("parseInfluxError(%d %s) failed: expected %s %v, got %s %v", test.status, test.body, test.kind, test.lines, result.Kind, result.Lines)
+		}
+	}
+}
+
+func TestInfluxDropUnparsableLines(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		if strings.Contains(string(data), "bad") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"unable to parse 'otgw bad=': missing field value"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config["influxIP"] = host
+	config["influxPort"] = port
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.sendWithRetry("otgw room_temperature=20.50\notgw bad=\notgw room_setpoint=21.00\n")
+	if err != nil || len(bodies) != 2 || bodies[1] != "otgw room_temperature=20.50\notgw room_setpoint=21.00\n" {
+		t.Errorf("sendWithRetry failed: expected the bad line to be removed, got %q (%v)", bodies, err)
+	}
+}
+
+func TestInfluxPartialWriteNotResent(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"partial write: unable to parse 'otgw bad=': missing field value dropped=1"}`))
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	config["influxIP"] = host
+	config["influxPort"] = port
+	s, err := newInfluxWriter("influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// influxdb 1.x already stored the other lines, sending them again would store them twice
+	err = s.sendWithRetry("otgw room_temperature=20.50\notgw bad=\notgw room_setpoint=21.00\n")
+	if err != nil || len(bodies) != 1 {
+		t.Errorf("sendWithRetry failed: expected the batch to be dropped after a partial write, got %q (%v)", bodies, err)
+	}
+}
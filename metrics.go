@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// data-IDs of the OpenTherm counters, these only increase and are exported as prometheus counters
+var openthermCounterIDs = map[uint8]bool{
+	116: true, // burner starts
+	117: true, // ch pump starts
+	118: true, // dhw pump/valve starts
+	119: true, // dhw burner starts
+	120: true, // burner operation hours
+	121: true, // ch pump operation hours
+	122: true, // dhw pump/valve operation hours
+	123: true, // dhw burner operation hours
+}
+
+// characters which are not allowed in a prometheus metric name, they are replaced by an underscore
+var metricInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+
+// metricName returns the prometheus name and type of a field, the OpenTherm counters get the _total suffix
+func metricName(prefix string, msgID uint8, field string) (string, string) {
+	name := metricInvalidChars.ReplaceAllString(fmt.Sprintf("%s_%s", prefix, field), "_")
+	if openthermCounterIDs[msgID] {
+		return name + "_total", "counter"
+	}
+	return name, "gauge"
+}
+
+// metricFamily is a prometheus metric with all its samples
+type metricFamily struct {
+	help       string
+	metricType string // gauge or counter
+	samples    []string
+}
+
+// metricSet collects the metric families of one scrape
+type metricSet map[string]*metricFamily
+
+func (m metricSet) add(name string, help string, metricType string, labels map[string]string, value float64) {
+	family, ok := m[name]
+	if !ok {
+		family = &metricFamily{help: help, metricType: metricType}
+		m[name] = family
+	}
+	family.samples = append(family.samples, fmt.Sprintf("%s%s %s", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64)))
+}
+
+// write returns the metrics in the prometheus text exposition format, sorted by name
+func (m metricSet) write() string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		family := m[name]
+		sort.Strings(family.samples)
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(family.help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.metricType)
+		for _, sample := range family.samples {
+			b.WriteString(sample + "\n")
+		}
+	}
+	return b.String()
+}
+
+// formatLabels formats the labels as {name="value",...}, labels with an empty value are left out
+func formatLabels(labels map[string]string) string {
+	var parts []string
+	for name, value := range labels {
+		if len(value) > 0 {
+			value = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+			parts = append(parts, fmt.Sprintf("%s=\"%s\"", name, value))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	sort.Strings(parts)
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// addFieldMetrics adds the latest value of every field of the gateway selected with the store_ settings,
+// which can be overridden for the exporter with metrics.store_<field>. Values older than metrics_max_age
+// seconds are left out so a silent boiler does not keep reporting its last temperature.
+func addFieldMetrics(m metricSet, gw *otgwGateway, now time.Time) {
+	prefix := config["metrics_prefix"]
+	if len(prefix) == 0 {
+		prefix = "otgw"
+	}
+	maxAge := time.Duration(configInt("metrics_max_age", 300)) * time.Second
+
+	for field, v := range gw.latestValues() {
+		if field == "reserved" || !isSinkField("metrics", gw.name, field) {
+			continue
+		}
+		if maxAge > 0 && now.Sub(v.received) > maxAge {
+			continue
+		}
+		value, err := v.float()
+		if err != nil {
+			continue
+		}
+
+		name, metricType := metricName(prefix, v.msgID, field)
+		m.add(name, v.readable, metricType, map[string]string{"device": gw.name, "data_id": strconv.Itoa(int(v.msgID))}, value)
+	}
+}
+
+// addSelfMetrics adds the counters of otgw2db itself
+func addSelfMetrics(m metricSet, gateways []*otgwGateway, sinks sinkSet) {
+	for _, gw := range gateways {
+		stats := gw.connStats()
+		labels := map[string]string{"device": gw.name}
+		connected := 0.0
+		if stats.State == connStateConnected {
+			connected = 1
+		}
+		m.add("otgw2db_connected", "Gateway connection state (1 = connected)", "gauge", labels, connected)
+		m.add("otgw2db_lines_received_total", "Lines received from the gateway", "counter", labels, float64(stats.LinesReceived))
+		m.add("otgw2db_frames_received_total", "Valid OpenTherm frames received from the gateway", "counter", labels, float64(stats.Frames))
+		m.add("otgw2db_parse_failures_total", "Lines from the gateway which are not a valid OpenTherm frame", "counter", labels, float64(stats.ParseFailures))
+		m.add("otgw2db_read_errors_total", "Read errors on the gateway connection", "counter", labels, float64(stats.ReadErrors))
+		m.add("otgw2db_disconnects_total", "Lost connections to the gateway", "counter", labels, float64(stats.Disconnects))
+	}
+
+	m.add("otgw2db_relay_clients", "Connected relay clients", "gauge", nil, float64(atomic.LoadInt64(&relayClientCount)))
+
+	influxErrorCountsLock.Lock()
+	for kind, count := range influxErrorCounts {
+		m.add("otgw2db_influx_write_errors_total", "Failed writes to influxdb by kind of error", "counter",
+			map[string]string{"kind": kind}, float64(count))
+	}
+	influxErrorCountsLock.Unlock()
+
+	for _, r := range sinks {
+		dropped, failed := r.counts()
+		labels := map[string]string{"sink": r.name}
+		m.add("otgw2db_sink_dropped_total", "Points and events dropped because the queue of the sink was full", "counter", labels, float64(dropped))
+		m.add("otgw2db_sink_failures_total", "Points and events the sink failed to write", "counter", labels, float64(failed))
+	}
+}
+
+// metricsHandler exports the latest OpenTherm values and the otgw2db counters for prometheus
+func metricsHandler(gateways []*otgwGateway, sinks sinkSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := make(metricSet)
+		now := time.Now()
+		for _, gw := range gateways {
+			addFieldMetrics(m, gw, now)
+		}
+		addSelfMetrics(m, gateways, sinks)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(m.write()))
+	}
+}
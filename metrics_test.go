@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["store_burner_starts"] = "YES"
+	config["metrics.store_dhw_enabled"] = "NO"
+
+	gw := &otgwGateway{name: "home", address: "test"}
+	gw.OT.device = gw.name
+	for _, msg := range []string{"B40193C33", "B40000200", "BC0740100"} {
+		gw.OT.ParseMessage(msg)
+		gw.recordValues()
+		gw.updateStats(func(s *otgwConnStats) { s.Frames++ })
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler([]*otgwGateway{gw}, nil)(rec, httptest.NewRequest("GET", "/metrics", nil))
+	result := rec.Body.String()
+
+	testTable := []struct {
+		out    string
+		exists bool
+	}{
+		{"# TYPE otgw_boiler_water_temp gauge\n", true},
+		{"otgw_boiler_water_temp{data_id=\"25\",device=\"home\"} 60.2\n", true},
+		{"otgw_ch_enabled{data_id=\"0\",device=\"home\"} 0\n", true},
+		{"otgw_dhw_enabled{", false},
+		{"# TYPE otgw_burner_starts_total counter\n", true},
+		{"otgw_burner_starts_total{data_id=\"116\",device=\"home\"} 256\n", true},
+		{"otgw2db_frames_received_total{device=\"home\"} 3\n", true},
+		{"otgw2db_relay_clients 0\n", true},
+	}
+
+	for _, test := range testTable {
+		if strings.Contains(result, test.out) != test.exists {
+			t.Errorf("metricsHandler failed: expected %q to be present %v, got:\n%s", test.out, test.exists, result)
+		}
+	}
+}
+
+func TestMetricName(t *testing.T) {
+
+	testTable := []struct {
+		prefix     string
+		msgID      uint8
+		field      string
+		name       string
+		metricType string
+	}{
+		{"otgw", 25, "boiler_water_temp", "otgw_boiler_water_temp", "gauge"},
+		{"otgw", 116, "burner_starts", "otgw_burner_starts_total", "counter"},
+		{"otgw", 12, "size_of_fault_buffer", "otgw_size_of_fault_buffer", "gauge"},
+		{"my-otgw", 0, "ch2.enabled", "my_otgw_ch2_enabled", "gauge"},
+	}
+
+	for _, test := range testTable {
+		if name, metricType := metricName(test.prefix, test.msgID, test.field); name != test.name || metricType != test.metricType {
+			t.Errorf("metricName(%q, %d, %q) failed: expected %s %s, got %s %s", test.prefix, test.msgID, test.field, test.name, test.metricType, name, metricType)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 packet types
+const (
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+var errMQTTNotConnected = errors.New("not connected to the mqtt broker")
+
+// mqttConnAckErrors are the reasons a broker refuses a connection
+var mqttConnAckErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client which publishes messages with QoS 0. It does not subscribe,
+// everything the broker sends apart from the connection handshake is read and ignored.
+type mqttClient struct {
+	broker      string // tcp://host:port, ssl://host:port or host:port
+	clientID    string
+	username    string
+	password    string
+	keepAlive   time.Duration
+	willTopic   string // published by the broker with willPayload when the connection is lost
+	willPayload string
+	tlsConfig   *tls.Config // used for ssl:// brokers
+
+	lock      sync.Mutex // protects conn and lastWrite, serializes writes
+	conn      net.Conn
+	lastWrite time.Time
+}
+
+// mqttString encodes a string with its length as used in MQTT packets
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket adds the fixed header to the variable header and payload of a packet
+func mqttPacket(packetType byte, flags byte, body []byte) []byte {
+	packet := []byte{packetType<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads a packet and returns its type, flags and the rest of the packet
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+		if i >= 3 {
+			return 0, 0, nil, errors.New("malformed mqtt packet length")
+		}
+	}
+
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header >> 4, header & 0x0f, body, err
+}
+
+// connectPacket returns the CONNECT packet with a clean session
+func (c *mqttClient) connectPacket() []byte {
+	var flags byte = 0x02 // clean session
+	payload := mqttString(c.clientID)
+	if len(c.willTopic) > 0 {
+		flags |= 0x04 | 0x20 // will flag and retained will message
+		payload = append(payload, mqttString(c.willTopic)...)
+		payload = append(payload, mqttString(c.willPayload)...)
+	}
+	if len(c.username) > 0 {
+		flags |= 0x80
+		payload = append(payload, mqttString(c.username)...)
+	}
+	if len(c.password) > 0 {
+		flags |= 0x40
+		payload = append(payload, mqttString(c.password)...)
+	}
+
+	body := append(mqttString("MQTT"), 4, flags, 0, 0) // protocol level 4 is MQTT 3.1.1
+	binary.BigEndian.PutUint16(body[len(body)-2:], uint16(c.keepAlive/time.Second))
+	return mqttPacket(mqttConnect, 0, append(body, payload...))
+}
+
+// dial opens the network connection to the broker
+func (c *mqttClient) dial() (net.Conn, error) {
+	address, secure := c.broker, false
+	if u, err := url.Parse(c.broker); err == nil && len(u.Host) > 0 {
+		switch u.Scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			secure = true
+		default:
+			return nil, fmt.Errorf("unknown mqtt broker scheme %s, use tcp or ssl", u.Scheme)
+		}
+		address = u.Host
+	}
+
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	if secure {
+		return tls.DialWithDialer(d, "tcp", address, c.tlsConfig)
+	}
+	return d.Dial("tcp", address)
+}
+
+// connect opens a new session with the broker
+func (c *mqttClient) connect() error {
+	c.close()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write(c.connectPacket())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	r := bufio.NewReader(conn)
+	packetType, _, body, err := readMQTTPacket(r)
+	if err == nil && (packetType != mqttConnAck || len(body) != 2) {
+		err = errors.New("unexpected response to connect")
+	}
+	if err == nil && body[1] != 0 {
+		err = fmt.Errorf("connection refused: %s", mqttConnAckErrors[body[1]])
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.lock.Lock()
+	c.conn = conn
+	c.lastWrite = time.Now()
+	c.lock.Unlock()
+
+	done := make(chan struct{})
+	go c.readLoop(conn, r, done)
+	go c.keepAliveLoop(conn, done)
+	return nil
+}
+
+// readLoop reads and ignores the packets of the broker until the connection is closed
+func (c *mqttClient) readLoop(conn net.Conn, r *bufio.Reader, done chan struct{}) {
+	defer close(done)
+	for {
+		if c.keepAlive > 0 {
+			// the broker answers our pings, so there must be traffic within the keep alive period
+			conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		}
+		_, _, _, err := readMQTTPacket(r)
+		if err != nil {
+			logVerbose.Println("Connection to the mqtt broker closed: ", err)
+			c.closeConn(conn)
+			return
+		}
+	}
+}
+
+// keepAliveLoop sends a ping when nothing was written during half the keep alive period
+func (c *mqttClient) keepAliveLoop(conn net.Conn, done chan struct{}) {
+	if c.keepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.keepAlive / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.lock.Lock()
+			idle := c.conn == conn && time.Since(c.lastWrite) > c.keepAlive/2
+			c.lock.Unlock()
+			if idle {
+				c.write(mqttPacket(mqttPingReq, 0, nil))
+			}
+		}
+	}
+}
+
+// write sends a packet, the connection is closed when that fails
+func (c *mqttClient) write(packet []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn == nil {
+		return errMQTTNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// publish sends a message with QoS 0
+func (c *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	var flags byte
+	if retain {
+		flags = 0x01
+	}
+	return c.write(mqttPacket(mqttPublish, flags, append(mqttString(topic), payload...)))
+}
+
+func (c *mqttClient) isConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.conn != nil
+}
+
+// closeConn closes conn if it is still the current connection
+func (c *mqttClient) closeConn(conn net.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conn.Close()
+	if c.conn == conn {
+		c.conn = nil
+	}
+}
+
+// close ends the session with a DISCONNECT, so the broker does not publish the will message
+func (c *mqttClient) close() {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+	if conn != nil {
+		c.write(mqttPacket(mqttDisconnect, 0, nil))
+		c.closeConn(conn)
+	}
+}
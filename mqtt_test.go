@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+type mqttMessage struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// startFakeBroker accepts mqtt connections and passes every published message to messages
+func startFakeBroker(t *testing.T, messages chan mqttMessage) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					packetType, flags, body, err := readMQTTPacket(r)
+					if err != nil {
+						return
+					}
+					switch packetType {
+					case mqttConnect:
+						conn.Write([]byte{mqttConnAck << 4, 2, 0, 0})
+					case mqttPingReq:
+						conn.Write([]byte{mqttPingResp << 4, 0})
+					case mqttPublish:
+						n := int(binary.BigEndian.Uint16(body))
+						messages <- mqttMessage{topic: string(body[2 : 2+n]), payload: string(body[2+n:]), retain: flags&1 == 1}
+					}
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestMQTTSink(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	messages := make(chan mqttMessage, 100)
+	config["mqtt_broker"] = "tcp://" + startFakeBroker(t, messages)
+	config["mqtt_topic_prefix"] = "heating"
+
+	s, err := newMQTTSink("mqtt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := openthermMessage{device: "home"}
+	for _, msg := range []string{"B40193C33", "B40000200"} {
+		ot.ParseMessage(msg)
+		point, _ := ot.DecodeToPoint()
+		if err := s.writePoint(point); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.close()
+
+	received := make(map[string]mqttMessage)
+	timeout := time.After(2 * time.Second)
+	for len(received) == 0 || received["heating/status"].payload != "offline" {
+		select {
+		case m := <-messages:
+			received[m.topic] = m
+		case <-timeout:
+			t.Fatalf("TestMQTTSink failed: timeout, received %v", received)
+		}
+	}
+
+	testTable := []struct {
+		topic   string
+		payload string
+	}{
+		{"heating/home/boiler_water_temp", "60.20"},
+		{"heating/home/dhw_enabled", "1"},
+		{"heating/status", "offline"},
+	}
+	for _, test := range testTable {
+		m := received[test.topic]
+		if m.payload != test.payload || !m.retain {
+			t.Errorf("publish %s failed: expected retained %s, got %+v", test.topic, test.payload, m)
+		}
+	}
+
+	var discovery mqttDiscoveryConfig
+	json.Unmarshal([]byte(received["homeassistant/sensor/home/boiler_water_temp/config"].payload), &discovery)
+	if discovery.Unit != "°C" || discovery.DeviceClass != "temperature" || discovery.StateTopic != "heating/home/boiler_water_temp" ||
+		discovery.Name != "Flow water temperature from boiler" || discovery.AvailabilityTopic != "heating/status" {
+		t.Errorf("discovery of boiler_water_temp failed: got %+v", discovery)
+	}
+	if _, ok := received["homeassistant/binary_sensor/home/flame_active/config"]; !ok {
+		t.Errorf("discovery of flame_active failed: no binary_sensor config")
+	}
+}
+
+func TestFieldUnit(t *testing.T) {
+
+	testTable := []struct {
+		msgID       uint8
+		readable    string
+		unit        string
+		deviceClass string
+	}{
+		{27, "Outside air temperature (°C)", "°C", "temperature"},
+		{18, "Water pressure of the boiler CH circuit (bar)", "bar", "pressure"},
+		{17, "Relative modulation level (%)", "%", ""},
+		{9, "Remote override room setpoint (0 = No override)", "", ""},
+		{120, "Number of hours that burner is in operation (i.e.flame on)", "h", "duration"},
+	}
+
+	for _, test := range testTable {
+		unit, deviceClass := fieldUnit(test.msgID, test.readable)
+		if unit != test.unit || deviceClass != test.deviceClass {
+			t.Errorf("fieldUnit(%s) failed: expected %s/%s, got %s/%s", test.readable, test.unit, test.deviceClass, unit, deviceClass)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// units of the fields as given at the end of their readable names, e.g. "Outside air temperature (°C)"
+var mqttUnits = map[string]string{
+	"°C":    "temperature",
+	"bar":   "pressure",
+	"kW":    "power",
+	"%":     "",
+	"l/min": "",
+}
+
+// fieldUnit returns the unit of measurement and the Home Assistant device class of a field
+func fieldUnit(msgID uint8, readable string) (string, string) {
+	if msgID >= 120 && msgID <= 123 {
+		return "h", "duration" // operation hours
+	}
+	if open := strings.LastIndex(readable, "("); open >= 0 && strings.HasSuffix(readable, ")") {
+		unit := readable[open+1 : len(readable)-1]
+		if deviceClass, ok := mqttUnits[unit]; ok {
+			return unit, deviceClass
+		}
+	}
+	return "", ""
+}
+
+// fieldName returns the readable name of a field without the unit
+func fieldName(readable string) string {
+	if unit, _ := fieldUnit(0, readable); len(unit) > 0 {
+		return strings.TrimSpace(readable[:strings.LastIndex(readable, "(")])
+	}
+	return readable
+}
+
+var mqttInvalidID = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// mqttDiscoveryConfig is the Home Assistant MQTT discovery message of a field
+type mqttDiscoveryConfig struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	ObjectID          string              `json:"object_id"`
+	StateTopic        string              `json:"state_topic"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	Unit              string              `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string              `json:"device_class,omitempty"`
+	StateClass        string              `json:"state_class,omitempty"`
+	PayloadOn         string              `json:"payload_on,omitempty"`
+	PayloadOff        string              `json:"payload_off,omitempty"`
+	Device            mqttDiscoveryDevice `json:"device"`
+}
+
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// mqttSink publishes every field to its own retained topic <mqtt_topic_prefix>/[<device>/]<field> and
+// announces the fields to Home Assistant with MQTT discovery messages
+type mqttSink struct {
+	name       string
+	client     *mqttClient
+	prefix     string
+	retain     bool
+	discovery  string // discovery prefix, empty when discovery is disabled
+	maxDelay   time.Duration
+	attempt    int
+	retryAt    time.Time
+	discovered map[string]bool // fields announced on the current connection
+}
+
+func newMQTTSink(name string) (sink, error) {
+	if len(sinkSetting(name, "mqtt_broker")) == 0 {
+		return nil, errors.New("mqtt_broker is not set")
+	}
+	tlsConfig, err := buildTLSConfig(sinkSetting(name, "mqtt_tls_ca"), sinkSetting(name, "mqtt_tls_cert"),
+		sinkSetting(name, "mqtt_tls_key"), strings.Contains(sinkSetting(name, "mqtt_tls_insecure"), "YES"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &mqttSink{
+		name:      name,
+		prefix:    strings.TrimSuffix(sinkSetting(name, "mqtt_topic_prefix"), "/"),
+		retain:    !strings.Contains(sinkSetting(name, "mqtt_retain"), "NO"),
+		discovery: sinkSetting(name, "mqtt_discovery_prefix"),
+		maxDelay:  time.Duration(sinkSettingInt(name, "mqtt_reconnect_max_delay", 300)) * time.Second,
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = "otgw"
+	}
+	if len(s.discovery) == 0 {
+		s.discovery = "homeassistant"
+	}
+	if strings.Contains(sinkSetting(name, "mqtt_discovery"), "NO") {
+		s.discovery = ""
+	}
+
+	clientID := sinkSetting(name, "mqtt_client_id")
+	if len(clientID) == 0 {
+		clientID = "otgw2db"
+	}
+	s.client = &mqttClient{
+		broker:      sinkSetting(name, "mqtt_broker"),
+		clientID:    clientID,
+		username:    sinkSetting(name, "mqtt_user"),
+		password:    sinkSetting(name, "mqtt_pass"),
+		keepAlive:   time.Duration(sinkSettingInt(name, "mqtt_keepalive", 60)) * time.Second,
+		willTopic:   s.statusTopic(),
+		willPayload: "offline",
+		tlsConfig:   tlsConfig,
+	}
+
+	// a broker which is down at startup is retried like a broker that goes down later
+	if err := s.connected(); err != nil {
+		log.Printf("Could not connect to mqtt broker %s: %v\n", s.client.broker, err)
+	}
+	return s, nil
+}
+
+// statusTopic is the availability topic of otgw2db, it is set to offline by the broker when the connection is lost
+func (s *mqttSink) statusTopic() string {
+	return s.prefix + "/status"
+}
+
+// topic returns the topic of a field or event of a device
+func (s *mqttSink) topic(device string, name string) string {
+	if len(device) > 0 {
+		return fmt.Sprintf("%s/%s/%s", s.prefix, device, name)
+	}
+	return fmt.Sprintf("%s/%s", s.prefix, name)
+}
+
+// connected (re)connects to the broker when needed, with an increasing delay between the attempts
+func (s *mqttSink) connected() error {
+	if s.client.isConnected() {
+		return nil
+	}
+	if time.Now().Before(s.retryAt) {
+		return errMQTTNotConnected
+	}
+
+	err := s.client.connect()
+	if err == nil {
+		err = s.client.publish(s.statusTopic(), []byte("online"), true)
+	}
+	if err != nil {
+		s.attempt++
+		s.retryAt = time.Now().Add(reconnectDelay(s.attempt, s.maxDelay))
+		return err
+	}
+
+	log.Printf("Connected to mqtt broker %s\n", s.client.broker)
+	s.attempt = 0
+	s.discovered = make(map[string]bool)
+	return nil
+}
+
+// discoveryMessage returns the topic and Home Assistant discovery config of a field
+func (s *mqttSink) discoveryMessage(device string, msgID uint8, f otgwField) (string, []byte) {
+	node := "otgw"
+	if len(device) > 0 {
+		node = mqttInvalidID.ReplaceAllString(device, "_")
+	}
+	unit, deviceClass := fieldUnit(msgID, f.readable)
+
+	c := mqttDiscoveryConfig{
+		Name:              fieldName(f.readable),
+		UniqueID:          fmt.Sprintf("otgw2db_%s_%s", node, f.name),
+		ObjectID:          fmt.Sprintf("%s_%s", node, f.name),
+		StateTopic:        s.topic(device, f.name),
+		AvailabilityTopic: s.statusTopic(),
+		Device: mqttDiscoveryDevice{
+			Identifiers:  []string{"otgw2db_" + node},
+			Name:         strings.TrimSpace("OpenTherm Gateway " + device),
+			Model:        "OpenTherm Gateway",
+			Manufacturer: "otgw2db",
+		},
+	}
+
+	component := "sensor"
+	if f.dataType == cTypeFlag8 {
+		component = "binary_sensor"
+		c.PayloadOn = "1"
+		c.PayloadOff = "0"
+	} else {
+		c.Unit = unit
+		c.DeviceClass = deviceClass
+		if openthermCounterIDs[msgID] {
+			c.StateClass = "total_increasing"
+		} else if len(unit) > 0 {
+			c.StateClass = "measurement"
+		}
+	}
+
+	payload, _ := json.Marshal(c)
+	return fmt.Sprintf("%s/%s/%s/%s/config", s.discovery, component, node, f.name), payload
+}
+
+func (s *mqttSink) writePoint(p otgwPoint) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+
+	for _, f := range p.fields {
+		if f.name == "reserved" {
+			continue
+		}
+		key := p.device + "/" + f.name
+		if len(s.discovery) > 0 && !s.discovered[key] {
+			topic, payload := s.discoveryMessage(p.device, p.msgID, f)
+			if err := s.client.publish(topic, payload, true); err != nil {
+				return err
+			}
+			s.discovered[key] = true
+		}
+		if err := s.client.publish(s.topic(p.device, f.name), []byte(f.value), s.retain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEvent publishes an event as json to <prefix>/[<device>/]events/<name>
+func (s *mqttSink) writeEvent(e otgwEvent) error {
+	if err := s.connected(); err != nil {
+		return err
+	}
+	payload, _ := json.Marshal(map[string]string{"state": e.state, "detail": e.detail, "time": e.time.Format(time.RFC3339)})
+	return s.client.publish(s.topic(e.device, "events/"+e.name), payload, s.retain)
+}
+
+// close marks otgw2db offline and ends the session
+func (s *mqttSink) close() error {
+	if s.client.isConnected() {
+		s.client.publish(s.statusTopic(), []byte("offline"), true)
+	}
+	s.client.close()
+	return nil
+}
@@ -36,6 +36,8 @@ type openthermMessage struct {
 	msgID   uint8
 	msgType uint8
 	payload []byte
+	device  string            // name of the gateway that produced the message, empty for a single unnamed gateway
+	tags    map[string]string // additional tags, e.g. otgw_firmware
 }
 
 func (ot *openthermMessage) ParseMessage(in string) bool {
@@ -55,44 +57,76 @@ func (ot *openthermMessage) ParseMessage(in string) bool {
 }
 
 func (ot *openthermMessage) DecodeToLineProtocol() string {
-	var output, sep string = "", ""
-
-	if ot.valid && ot.isDecodableMsgType() {
+	point, ok := ot.DecodeToPoint()
+	if !ok {
+		return ""
+	}
+	return point.selectFields(ot.isStoredField).lineProtocol()
+}
 
-		values := ot.decodeValues()
+// DecodeToPoint returns all fields of the message with their decoded values, the store_ settings are
+// not applied so every sink can make its own selection
+func (ot *openthermMessage) DecodeToPoint() (otgwPoint, bool) {
+	if !ot.valid || !ot.isDecodableMsgType() {
+		return otgwPoint{}, false
+	}
 
-		for n, field := range openthermFieldNames[ot.msgID] {
-			if strings.Contains(config[fmt.Sprintf("store_%s", field)], "YES") {
-				output += fmt.Sprintf("%s%s=%s", sep, field, values[n])
-				sep = "," // prepare for a possible next field
-			}
-		}
+	point := otgwPoint{
+		measurement: config["influxMeasurementName"],
+		device:      ot.device,
+		tags:        ot.tags,
+		msgID:       ot.msgID,
+		time:        time.Now(),
+	}
 
-		if len(output) > 0 {
-			output = fmt.Sprintf("%s %s %v\n", config["influxMeasurementName"], output, time.Now().Unix())
+	values := ot.decodeValues()
+	types := ot.fieldTypes()
+	for n, field := range openthermFieldNames[ot.msgID] {
+		if n < len(values) {
+			point.fields = append(point.fields, otgwField{
+				name:     field,
+				readable: openthermReadableNames[ot.msgID][n],
+				dataType: types[n],
+				value:    values[n],
+			})
 		}
 	}
-	return output
+	return point, len(point.fields) > 0
 }
 
-func (ot *openthermMessage) DecodeToReadable() string {
-	var output, sep string = "", ""
-
-	if ot.valid && ot.isDecodableMsgType() {
-
-		values := ot.decodeValues()
+// fieldTypes returns the data type of every field of the message, in the same order as decodeValues
+func (ot *openthermMessage) fieldTypes() []uint8 {
+	var output []uint8
 
-		for n, field := range openthermFieldNames[ot.msgID] {
-			if strings.Contains(config[fmt.Sprintf("store_%s", field)], "YES") {
-				output += fmt.Sprintf("%s%s: %s", sep, openthermReadableNames[ot.msgID][n], values[n])
-				sep = "\n" // prepare for a possible next field
+	for _, valueType := range openthermFieldTypes[ot.msgID] {
+		switch valueType {
+		case cTypeFlag8:
+			for i := 0; i <= 7; i++ {
+				output = append(output, cTypeFlag8)
 			}
+		case cTypeU8WDT:
+			output = append(output, cTypeU8, cTypeU8) // day of week and hours
+		case cTypeNone:
+		default:
+			output = append(output, valueType)
 		}
-
 	}
 	return output
 }
 
+func (ot *openthermMessage) DecodeToReadable() string {
+	point, ok := ot.DecodeToPoint()
+	if !ok {
+		return ""
+	}
+	return point.selectFields(ot.isStoredField).readable()
+}
+
+// isStoredField checks the store_ setting of a field, taking per device overrides into account
+func (ot *openthermMessage) isStoredField(field string) bool {
+	return strings.Contains(deviceSetting(ot.device, fmt.Sprintf("store_%s", field)), "YES")
+}
+
 func (ot *openthermMessage) decodeValues() []string {
 	var output []string
 
@@ -211,7 +245,7 @@ var openthermFieldNames = map[uint8][]string{
 	9:   {"remote_override_room_setpoint"},
 	10:  {"number_of_tsps"},
 	11:  {"tsp_index", "tsp_value"},
-	12:  {"size_of_fault_buffer "},
+	12:  {"size_of_fault_buffer"},
 	13:  {"fhb_fault_index", "fhb_fault_value"},
 	14:  {"maximum_relative_modulation_level_setting"},
 	15:  {"maximum_boiler_capacity", "minimum_boiler_modulation"},
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -84,3 +85,50 @@ func TestNewDecodeReadable(t *testing.T) {
 		}
 	}
 }
+
+func TestDeviceDecodeLP(t *testing.T) {
+
+	testTable := []struct {
+		device   string
+		override string
+		in       string
+		out      string
+	}{
+		{"", "", "B40193C33", "otgw boiler_water_temp=60.20 "},
+		{"boiler", "", "B40193C33", "otgw,device=boiler boiler_water_temp=60.20 "},
+		{"ventilation", "NO", "B40193C33", ""},
+	}
+	readConfig("otgw2db.testing.cfg")
+
+	for _, test := range testTable {
+		testOT := openthermMessage{device: test.device}
+		if len(test.override) > 0 {
+			config[test.device+".store_boiler_water_temp"] = test.override
+		}
+		_ = testOT.ParseMessage(test.in)
+		result := testOT.DecodeToLineProtocol()
+		if !strings.HasPrefix(result, test.out) || (len(test.out) == 0 && len(result) > 0) {
+			t.Errorf("DeviceDecodeLP(\"%v\", \"%v\") failed: expected \"%s\", got \"%s\"", test.device, test.in, test.out, result)
+		}
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+
+	// the names are used as they are in line protocol, metric names, mqtt topics, columns and settings
+	valid := regexp.MustCompile("^[a-zA-Z0-9_]+$")
+	for id, fields := range openthermFieldNames {
+		for _, field := range fields {
+			if !valid.MatchString(field) {
+				t.Errorf("field name %q of data-id %d is not valid", field, id)
+			}
+		}
+	}
+
+	ot := openthermMessage{}
+	ot.ParseMessage("B400C0300")
+	point, _ := ot.DecodeToPoint()
+	if len(point.fields) == 0 || point.fields[0].name != "size_of_fault_buffer" || strings.Contains(point.lineProtocol(), "buffer ") {
+		t.Errorf("DecodeToPoint failed: unexpected fields %v", point.fields)
+	}
+}
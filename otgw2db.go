@@ -2,18 +2,18 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"container/list"
-	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -24,18 +24,11 @@ var ( // these variable as set at build time, they do not belong in the config m
 
 var config map[string]string
 
-var dbBuffer string
-var dbBufferCount int
-
-const dbBufferMaxCount = 20 // number of influx points to collect before sending them to the database
-
-var influxWriteURL = "http://%s:%s/api/v2/write?bucket=%s&precision=s"
+var relayClientCount int64 // number of connected relay clients, read with atomic
 
 var logVerbose = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
 var verboseFlagSet = false
 
-var maxOtgwReconnectDelay = 600 // max delay in seconds for exponential back-off
-
 func readConfig(fn string) {
 	config = make(map[string]string)
 	file, err := os.Open(fn)
@@ -60,56 +53,13 @@ func readConfig(fn string) {
 	}
 }
 
-func sendToInfluxBuffer(out chan string) {
-	var msgWritten = 0
-
-	for {
-		lp := <-out
-		dbBuffer += lp
-		dbBufferCount++
-		logVerbose.Print("Added message ", dbBufferCount, " to the buffer:", lp)
-
-		if dbBufferCount >= dbBufferMaxCount {
-			err := sendToInfluxDB(dbBuffer)
-			if err != nil {
-				log.Println("Could not submit data to influxdb. Dropping data points")
-			} else {
-				msgWritten += dbBufferCount
-				logVerbose.Printf("Submitted %v points to influxdb. total points written: %v\n", dbBufferCount, msgWritten)
-			}
-			dbBuffer = ""
-			dbBufferCount = 0
-		}
-	}
-}
-
-func sendToInfluxDB(postBody string) error {
-
-	influxURL := fmt.Sprintf(influxWriteURL,
-		config["influxIP"],
-		config["influxPort"],
-		config["influxBucket"])
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", influxURL, bytes.NewBufferString(postBody))
-	if err != nil {
-		log.Println("Creating http request failed: ", err.Error())
-	}
-	// log.Println(req)
-	req.Header.Add("Authentication", fmt.Sprintf("Token %s:%s", config["influxUser"], config["influxPass"]))
-	resp, err := client.Do(req)
+// configInt returns the integer value of a setting or def if the setting is missing or not a number
+func configInt(key string, def int) int {
+	val, err := strconv.Atoi(config[key])
 	if err != nil {
-		log.Println("Http POST to influxdb failed: ", err.Error())
-		return err
+		return def
 	}
-
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 204 {
-		log.Println("Http POST to influxdb returned status:", resp.Status)
-		err = errors.New("Database does not accept data. Check settings")
-	}
-	return err
+	return val
 }
 
 func startRelayListener(c chan net.Conn) {
@@ -141,6 +91,7 @@ func sendRelayMessages(m chan string, c chan net.Conn) {
 			{
 				log.Printf("Relay client connected from: %s\n", conn.RemoteAddr().String())
 				conns.PushBack(conn)
+				atomic.AddInt64(&relayClientCount, 1)
 			}
 		case currentMsg = <-m:
 			for con := conns.Front(); con != nil; con = con.Next() {
@@ -150,6 +101,7 @@ func sendRelayMessages(m chan string, c chan net.Conn) {
 				if err != nil {
 					log.Println("Relay error writing message:", err)
 					conns.Remove(con)
+					atomic.AddInt64(&relayClientCount, -1)
 				}
 			}
 		default:
@@ -159,80 +111,31 @@ func sendRelayMessages(m chan string, c chan net.Conn) {
 	}
 }
 
-func readMessagesFromOTGW(c chan string) {
-
-	var connSuccess = false // used to indicate whether there has ever been a successful connection
-	var connRetryCounter = 0
-	var otgwReconnectDelay = 0
-	var readErrorCount = 0
-
-	for {
-		d := net.Dialer{Timeout: 2 * time.Second}
-		conn, err := d.Dial("tcp", config["OTGWaddress"])
-
-		if err != nil {
-			connRetryCounter++
-			log.Println("Connection to otgw could not be established. Attempt ", connRetryCounter)
-			if (connSuccess == false) && (connRetryCounter >= 3) {
-				log.Fatal("Aborting program. Check your settings in otgw2db.cfg\n") // abort after 3 tries if there has not previously been a connection
-			} else {
-				time.Sleep(time.Second * time.Duration(otgwReconnectDelay))
-
-				// exponential back-off on reconnecting to the OTGW
-				if otgwReconnectDelay < maxOtgwReconnectDelay {
-					otgwReconnectDelay = (1 << connRetryCounter)
-				} else {
-					otgwReconnectDelay = maxOtgwReconnectDelay
-				}
-
-				continue
-			}
-		} else {
-			connSuccess = true
-
-			// reset counters
-			connRetryCounter = 0
-			otgwReconnectDelay = 0
-			readErrorCount = 0
-
-			log.Println("Succesfully connected to OTGW at: ", conn.RemoteAddr())
-		}
-
-		for {
-			conn.SetReadDeadline(time.Now().Add(time.Second * 10))
-			msgIn, err := bufio.NewReader(conn).ReadString('\n')
-			if err != nil {
-				readErrorCount++
-				log.Println("Error reading from otgw (count ", readErrorCount, "): ", err)
-				if (err == io.EOF) || (readErrorCount > 5) {
-					log.Println("Connection has timed out or was closed by otgw")
-					break
-				}
-			} else {
-				readErrorCount = 0
-				if len(c) == cap(c) {
-					_ = <-c //	dump a value from the channel
-				}
-				c <- msgIn
-			}
+// queueLineProtocol passes a point to the influx writer without blocking the main loop while the
+// writer is retrying. The oldest point is dropped when the queue is full.
+func queueLineProtocol(c chan string, lp string) {
+	select {
+	case c <- lp:
+	default:
+		select {
+		case <-c: // dump value from channel
+		default:
 		}
+		c <- lp
 	}
 }
 
-func influxTest() bool {
-
-	err := sendToInfluxDB("")
-	if err != nil {
-		log.Println("Influxdb test error: ", err)
-		return false
-	}
-	return true
-}
-
 func main() {
 	log.Printf("OTGW2DB - starting program (version: %s / build time: %s )\n", sha1ver, buildTime)
 
+	var device string
+
 	flag.BoolVar(&verboseFlagSet, "v", false, ": set logging to verbose. Main use is testing, creates very large logs")
+	flag.StringVar(&device, "d", "", ": name of the OTGW device used by the backup and restore commands")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-v] [-d device] [backup|restore file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if verboseFlagSet {
 		logVerbose.SetOutput(os.Stdout)
@@ -240,45 +143,81 @@ func main() {
 
 	readConfig("otgw2db.cfg")
 
-	if !influxTest() {
-		log.Fatal("Could not connect to influxdb. Please check the settings in otgw2db.cfg")
+	if flag.NArg() > 0 {
+		if (flag.Arg(0) != "backup" && flag.Arg(0) != "restore") || flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		runSettingsCommand(flag.Arg(0), flag.Arg(1), device)
+		return
 	}
 
-	OT := openthermMessage{}
+	sinks := startSinks()
+	gateways := readGateways()
+	sinks.watchGateways(gateways)
 
-	receiveMessages := make(chan string, 10)
-	sendMessages := make(chan string, 10)
+	receiveMessages := make(chan otgwLine, 10*len(gateways))
 	relayMessages := make(chan string, 10)
 	relayClients := make(chan net.Conn)
 
-	go readMessagesFromOTGW(receiveMessages)
-	go sendToInfluxBuffer(sendMessages)
+	for _, gw := range gateways {
+		go readMessagesFromOTGW(gw, receiveMessages)
+		go gw.pollDataIDs()
+		go gw.pushToGateway(gateways)
+	}
 	go startRelayListener(relayClients)
 	go sendRelayMessages(relayMessages, relayClients)
+	if len(config["api_http_port"]) > 0 {
+		registerAPI(gateways)
+	}
+	if len(config["health_http_port"]) > 0 {
+		handleHTTP("", config["health_http_port"], "/health", healthHandler(gateways))
+	}
+	if len(config["metrics_http_port"]) > 0 {
+		handleHTTP("", config["metrics_http_port"], "/metrics", metricsHandler(gateways, sinks))
+	}
+	startHTTPServers()
+
+	watchdogTicker := time.NewTicker(time.Second)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
 	for {
-		message := <-receiveMessages
-		logVerbose.Print("Message from OTGW: " + message)
+		var line otgwLine
+		select {
+		case sig := <-signals:
+			log.Println("Received", sig, "- stopping")
+			sinks.close(time.Minute)
+			return
+		case now := <-watchdogTicker.C:
+			for _, gw := range gateways {
+				gw.checkWatchdog(now)
+			}
+			continue
+		case line = <-receiveMessages:
+		case e := <-events:
+			sinks.writeEvent(e)
+			continue
+		}
+		gw := line.gw
+		message := line.msg
+		logVerbose.Print("Message from OTGW ", gw.label(), ": ", message)
 		if len(relayMessages) == cap(relayMessages) {
 			_ = <-relayMessages // dump value from channel
 		}
 		relayMessages <- message
 
-		if OT.ParseMessage(message) {
+		if gw.OT.ParseMessage(message) {
+			gw.updateStats(func(s *otgwConnStats) { s.Frames++ })
+			gw.frameReceived(message)
+			gw.recordValues()
+			gw.OT.tags = gw.identityTags()
 
-			if strings.Contains(config["decode_readable"], "YES") {
-				readable := OT.DecodeToReadable()
-				if len(readable) > 0 {
-					fmt.Println(readable)
-				}
-			}
-
-			if strings.Contains(config["decode_line_protocol"], "YES") {
-				lp := OT.DecodeToLineProtocol()
-				if len(lp) > 0 {
-					sendMessages <- lp
-				}
+			if point, ok := gw.OT.DecodeToPoint(); ok {
+				sinks.writePoint(point)
 			}
+		} else {
+			gw.updateStats(func(s *otgwConnStats) { s.ParseFailures++ })
 		}
 		time.Sleep(time.Millisecond * 10) // add small delay to the main loop to reduce cpu usage
 	}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// UCUM units of the field units, as used by OpenTelemetry
+var otlpUnits = map[string]string{
+	"°C":    "Cel",
+	"bar":   "bar",
+	"kW":    "kW",
+	"%":     "%",
+	"l/min": "l/min",
+	"h":     "h",
+}
+
+// otlpDataPoint is a single value of a metric
+type otlpDataPoint struct {
+	attributes map[string]string
+	start      time.Time // start of a cumulative sum
+	time       time.Time
+	value      float64
+}
+
+// otlpMetric is a gauge or a cumulative monotonic sum with its data points
+type otlpMetric struct {
+	name        string
+	description string
+	unit        string
+	sum         bool
+	points      []otlpDataPoint
+}
+
+// otlpResource is the set of metrics of one gateway, the resource attributes identify the gateway
+type otlpResource struct {
+	attributes map[string]string
+	metrics    map[string]*otlpMetric
+}
+
+func (r *otlpResource) add(name string, description string, unit string, sum bool, p otlpDataPoint) {
+	m, ok := r.metrics[name]
+	if !ok {
+		m = &otlpMetric{name: name, description: description, unit: unit, sum: sum}
+		r.metrics[name] = m
+	}
+	m.points = append(m.points, p)
+}
+
+// otlpValue is the latest value of a field
+type otlpValue struct {
+	field otgwField
+	msgID uint8
+	time  time.Time
+	value float64
+}
+
+// otlpSink exports the latest value of the stored fields and the counters of otgw2db as OpenTelemetry
+// metrics every otlp_interval seconds, over http/protobuf or grpc. Every gateway is a resource with its
+// name, address, firmware and mode as attributes.
+type otlpSink struct {
+	name     string
+	url      string
+	grpc     bool
+	client   *http.Client
+	headers  map[string]string
+	prefix   string
+	interval time.Duration
+	maxAge   time.Duration
+	started  time.Time
+	exported time.Time
+	exports  int                             // successful exports, see sinkBatcher
+	values   map[string]map[string]otlpValue // by device and field
+
+	gatewaysLock sync.Mutex
+	gateways     []*otgwGateway
+	sinks        sinkSet
+}
+
+func newOTLPSink(name string) (sink, error) {
+	endpoint := strings.TrimSuffix(sinkSetting(name, "otlp_endpoint"), "/")
+	if len(endpoint) == 0 {
+		return nil, errors.New("otlp_endpoint is not set")
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := buildTLSConfig(sinkSetting(name, "otlp_tls_ca"), sinkSetting(name, "otlp_tls_cert"),
+		sinkSetting(name, "otlp_tls_key"), strings.Contains(sinkSetting(name, "otlp_tls_insecure"), "YES"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &otlpSink{
+		name:     name,
+		headers:  make(map[string]string),
+		prefix:   sinkSetting(name, "otlp_prefix"),
+		interval: time.Duration(sinkSettingInt(name, "otlp_interval", 60)) * time.Second,
+		maxAge:   time.Duration(sinkSettingInt(name, "otlp_max_age", 300)) * time.Second,
+		started:  time.Now(),
+		exported: time.Now(),
+		values:   make(map[string]map[string]otlpValue),
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = "otgw"
+	}
+	for _, header := range strings.Split(sinkSetting(name, "otlp_headers"), ",") {
+		if kv := strings.SplitN(header, "=", 2); len(kv) == 2 {
+			s.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	switch strings.ToLower(sinkSetting(name, "otlp_protocol")) {
+	case "", "http/protobuf", "http":
+		s.url = endpoint
+		if !strings.HasSuffix(u.Path, "/v1/metrics") {
+			s.url += "/v1/metrics"
+		}
+	case "grpc":
+		// grpc needs http/2, also without tls (h2c) which is the default of the collector on port 4317
+		s.grpc = true
+		s.url = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, otlpGRPCPath)
+		protocols := new(http.Protocols)
+		if u.Scheme == "https" {
+			protocols.SetHTTP2(true)
+		} else {
+			protocols.SetUnencryptedHTTP2(true)
+		}
+		transport.Protocols = protocols
+	default:
+		return nil, fmt.Errorf("unknown otlp_protocol %s, use http/protobuf or grpc", sinkSetting(name, "otlp_protocol"))
+	}
+	s.client = &http.Client{Timeout: time.Duration(sinkSettingInt(name, "otlp_timeout", 10)) * time.Second, Transport: transport}
+	return s, nil
+}
+
+func (s *otlpSink) watchGateways(gateways []*otgwGateway, sinks sinkSet) {
+	s.gatewaysLock.Lock()
+	defer s.gatewaysLock.Unlock()
+	s.gateways = gateways
+	s.sinks = sinks
+}
+
+func (s *otlpSink) writePoint(p otgwPoint) error {
+	if s.values[p.device] == nil {
+		s.values[p.device] = make(map[string]otlpValue)
+	}
+	for _, f := range p.fields {
+		value, err := f.float()
+		if err == nil && f.name != "reserved" {
+			s.values[p.device][f.name] = otlpValue{field: f, msgID: p.msgID, time: p.time, value: value}
+		}
+	}
+	return nil
+}
+
+func (s *otlpSink) writeEvent(e otgwEvent) error {
+	return nil
+}
+
+func (s *otlpSink) sent() int {
+	return s.exports
+}
+
+func (s *otlpSink) flush(now time.Time) error {
+	if now.Sub(s.exported) < s.interval {
+		return nil
+	}
+	s.exported = now
+	return s.export(now)
+}
+
+func (s *otlpSink) close() error {
+	return s.export(time.Now())
+}
+
+// resources collects the metrics of every gateway and of otgw2db itself
+func (s *otlpSink) resources(now time.Time) []*otlpResource {
+	byDevice := make(map[string]*otlpResource)
+	resource := func(device string) *otlpResource {
+		r, ok := byDevice[device]
+		if !ok {
+			r = &otlpResource{
+				attributes: map[string]string{"service.name": "otgw2db", "service.version": sha1ver, "otgw.device": device},
+				metrics:    make(map[string]*otlpMetric),
+			}
+			byDevice[device] = r
+		}
+		return r
+	}
+
+	for device, values := range s.values {
+		for field, v := range values {
+			if s.maxAge > 0 && now.Sub(v.time) > s.maxAge {
+				continue
+			}
+			unit, _ := fieldUnit(v.msgID, v.field.readable)
+			p := otlpDataPoint{time: v.time, value: v.value, start: s.started}
+			resource(device).add(fmt.Sprintf("%s.%s", s.prefix, field), v.field.readable, otlpUnits[unit], openthermCounterIDs[v.msgID], p)
+		}
+	}
+
+	s.gatewaysLock.Lock()
+	gateways, sinks := s.gateways, s.sinks
+	s.gatewaysLock.Unlock()
+
+	counter := func(r *otlpResource, name string, description string, value float64, attributes map[string]string) {
+		r.add(name, description, "1", true, otlpDataPoint{attributes: attributes, start: s.started, time: now, value: value})
+	}
+	for _, gw := range gateways {
+		r := resource(gw.name)
+		r.attributes["otgw.address"] = gw.address
+		r.attributes["otgw.firmware"] = gw.identityValue("firmware")
+		r.attributes["otgw.mode"] = gw.identityValue("mode")
+
+		stats := gw.connStats()
+		connected := 0.0
+		if stats.State == connStateConnected {
+			connected = 1
+		}
+		r.add("otgw2db.connected", "Gateway connection state (1 = connected)", "1", false, otlpDataPoint{time: now, value: connected})
+		counter(r, "otgw2db.lines_received", "Lines received from the gateway", float64(stats.LinesReceived), nil)
+		counter(r, "otgw2db.frames_received", "Valid OpenTherm frames received from the gateway", float64(stats.Frames), nil)
+		counter(r, "otgw2db.parse_failures", "Lines from the gateway which are not a valid OpenTherm frame", float64(stats.ParseFailures), nil)
+		counter(r, "otgw2db.disconnects", "Lost connections to the gateway", float64(stats.Disconnects), nil)
+	}
+
+	// the counters of otgw2db itself are added to the resource without a device
+	r := resource("")
+	r.add("otgw2db.relay_clients", "Connected relay clients", "1", false,
+		otlpDataPoint{time: now, value: float64(atomic.LoadInt64(&relayClientCount))})
+	influxErrorCountsLock.Lock()
+	for kind, count := range influxErrorCounts {
+		counter(r, "otgw2db.influx_write_errors", "Failed writes to influxdb by kind of error", float64(count), map[string]string{"kind": kind})
+	}
+	influxErrorCountsLock.Unlock()
+	for _, runner := range sinks {
+		dropped, failed := runner.counts()
+		counter(r, "otgw2db.sink_dropped", "Points and events dropped because the queue of the sink was full", float64(dropped), map[string]string{"sink": runner.name})
+		counter(r, "otgw2db.sink_failures", "Points and events the sink failed to write", float64(failed), map[string]string{"sink": runner.name})
+	}
+
+	devices := make([]string, 0, len(byDevice))
+	for device := range byDevice {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	var resources []*otlpResource
+	for _, device := range devices {
+		resources = append(resources, byDevice[device])
+	}
+	return resources
+}
+
+// otlpAttributes encodes attributes as KeyValue messages in field number field, empty values are left out
+func otlpAttributes(b *protoBuffer, field int, attributes map[string]string) {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(attributes[k]) == 0 {
+			continue
+		}
+		var value, kv protoBuffer
+		value.string(1, attributes[k])
+		kv.string(1, k)
+		kv.message(2, value)
+		b.message(field, kv)
+	}
+}
+
+// exportRequest encodes the resources as an ExportMetricsServiceRequest
+func exportRequest(resources []*otlpResource) []byte {
+	var request protoBuffer
+
+	for _, r := range resources {
+		var scope protoBuffer
+		scope.string(1, "otgw2db")
+		scope.string(2, sha1ver)
+
+		var scopeMetrics protoBuffer
+		scopeMetrics.message(1, scope)
+
+		names := make([]string, 0, len(r.metrics))
+		for name := range r.metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			m := r.metrics[name]
+			var data protoBuffer
+			for _, p := range m.points {
+				var point protoBuffer
+				if m.sum {
+					point.fixed64(2, uint64(p.start.UnixNano()))
+				}
+				point.fixed64(3, uint64(p.time.UnixNano()))
+				point.double(4, p.value)
+				otlpAttributes(&point, 7, p.attributes)
+				data.message(1, point)
+			}
+
+			var metric protoBuffer
+			metric.string(1, m.name)
+			metric.string(2, m.description)
+			metric.string(3, m.unit)
+			if m.sum {
+				data.int64(2, 2) // cumulative aggregation temporality
+				data.int64(3, 1) // monotonic
+				metric.message(7, data)
+			} else {
+				metric.message(5, data)
+			}
+			scopeMetrics.message(2, metric)
+		}
+
+		var resource protoBuffer
+		otlpAttributes(&resource, 1, r.attributes)
+
+		var resourceMetrics protoBuffer
+		resourceMetrics.message(1, resource)
+		resourceMetrics.message(2, scopeMetrics)
+		request.message(1, resourceMetrics)
+	}
+	return request
+}
+
+// export sends the metrics to the collector
+func (s *otlpSink) export(now time.Time) error {
+	body := exportRequest(s.resources(now))
+	contentType := "application/x-protobuf"
+	if s.grpc {
+		// grpc message framing: not compressed, 4 byte length
+		frame := make([]byte, 5, 5+len(body))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+		body = append(frame, body...)
+		contentType = "application/grpc"
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "otgw2db/"+sha1ver)
+	if s.grpc {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)) // the trailers are only available after the body
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("otlp export returned status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if s.grpc {
+		status := resp.Trailer.Get("Grpc-Status")
+		if len(status) == 0 {
+			status = resp.Header.Get("Grpc-Status") // trailers-only response
+		}
+		if status != "0" {
+			return fmt.Errorf("otlp export failed with grpc status %s: %s", status, resp.Trailer.Get("Grpc-Message")+resp.Header.Get("Grpc-Message"))
+		}
+	}
+	logVerbose.Printf("Exported metrics to %s\n", s.url)
+	s.exports++
+	return nil
+}
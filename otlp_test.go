@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// otlpMetrics decodes an export request to the metrics of every device, by name
+func otlpMetrics(t *testing.T, request []byte) map[string]map[string]map[int][][]byte {
+	devices := make(map[string]map[string]map[int][][]byte)
+	for _, rm := range protoFields(request)[1] {
+		resourceMetrics := protoFields(rm)
+		attributes := make(map[string]string)
+		for _, kv := range protoFields(resourceMetrics[1][0])[1] {
+			fields := protoFields(kv)
+			attributes[string(fields[1][0])] = string(protoFields(fields[2][0])[1][0])
+		}
+		if attributes["service.name"] != "otgw2db" {
+			t.Errorf("otlp resource failed: got attributes %v", attributes)
+		}
+
+		metrics := make(map[string]map[int][][]byte)
+		metrics["attributes"] = map[int][][]byte{0: {[]byte(attributes["otgw.firmware"])}}
+		for _, m := range protoFields(resourceMetrics[2][0])[2] {
+			fields := protoFields(m)
+			metrics[string(fields[1][0])] = fields
+		}
+		devices[attributes["otgw.device"]] = metrics
+	}
+	return devices
+}
+
+func TestOTLPExport(t *testing.T) {
+
+	testTable := []struct {
+		protocol string
+		grpc     bool
+	}{
+		{"http/protobuf", false},
+		{"grpc", true},
+	}
+
+	for _, test := range testTable {
+		requests := make(chan []byte, 10)
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if test.grpc {
+				if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				body = body[5:]
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Write([]byte{0, 0, 0, 0, 0})
+				w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			} else if r.URL.Path != "/v1/metrics" || r.Header.Get("X-Api-Key") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			requests <- body
+		}))
+		server.Config.Protocols = new(http.Protocols)
+		server.Config.Protocols.SetHTTP1(true)
+		server.Config.Protocols.SetUnencryptedHTTP2(true)
+		server.Start()
+
+		readConfig("otgw2db.testing.cfg")
+		config["otlp_endpoint"] = server.URL
+		config["otlp_protocol"] = test.protocol
+		config["otlp_headers"] = "X-Api-Key=secret"
+		config["store_burner_starts"] = "YES"
+
+		s, err := newOTLPSink("otlp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		gw := &otgwGateway{name: "home", address: "test", identity: map[string]string{"firmware": "6.4"}}
+		gw.updateStats(func(s *otgwConnStats) { s.Frames = 2 })
+		s.(sinkGatewayWatcher).watchGateways([]*otgwGateway{gw}, nil)
+
+		ot := openthermMessage{device: "home"}
+		for _, msg := range []string{"B40193C33", "BC0740100"} {
+			ot.ParseMessage(msg)
+			point, _ := ot.DecodeToPoint()
+			s.writePoint(point)
+		}
+		if err := s.(*otlpSink).flush(time.Now()); err != nil || len(requests) != 0 {
+			t.Errorf("%s export failed: exported before otlp_interval", test.protocol)
+		}
+		if err := s.close(); err != nil {
+			t.Fatalf("%s export failed: %v", test.protocol, err)
+		}
+		server.Close()
+
+		metrics := otlpMetrics(t, <-requests)["home"]
+		if metrics == nil {
+			t.Fatalf("%s export failed: no resource for device home", test.protocol)
+		}
+		if string(metrics["attributes"][0][0]) != "6.4" {
+			t.Errorf("%s export failed: expected firmware attribute 6.4, got %s", test.protocol, metrics["attributes"][0][0])
+		}
+
+		temp := metrics["otgw.boiler_water_temp"]
+		if temp == nil || string(temp[3][0]) != "Cel" || temp[5] == nil {
+			t.Fatalf("%s export failed: boiler_water_temp is not a gauge in Cel", test.protocol)
+		}
+		point := protoFields(protoFields(temp[5][0])[1][0])
+		if value := math.Float64frombits(binary.LittleEndian.Uint64(point[4][0])); math.Abs(value-60.2) > 0.01 {
+			t.Errorf("%s export failed: expected 60.2, got %v", test.protocol, value)
+		}
+		for _, name := range []string{"otgw.burner_starts", "otgw2db.frames_received"} {
+			if metrics[name] == nil || metrics[name][7] == nil {
+				t.Errorf("%s export failed: %s is not a sum", test.protocol, name)
+			}
+		}
+	}
+}
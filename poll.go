@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pollSchedule returns the data-IDs which have to be requested from the boiler with their interval.
+// A data-ID is polled when any of its fields has a poll_<field> setting, the shortest interval wins.
+func (gw *otgwGateway) pollSchedule() map[uint8]time.Duration {
+	schedule := make(map[uint8]time.Duration)
+
+	for id, fields := range openthermFieldNames {
+		for _, field := range fields {
+			seconds := gw.settingInt(fmt.Sprintf("poll_%s", field), 0)
+			if seconds <= 0 {
+				continue
+			}
+			interval := time.Duration(seconds) * time.Second
+			if current, ok := schedule[id]; !ok || interval < current {
+				schedule[id] = interval
+			}
+		}
+	}
+	return schedule
+}
+
+// pollDataIDs makes sure the data-IDs of the poll schedule are requested from the boiler even when
+// the thermostat never reads them. With poll_method = PM a priority message is sent every interval,
+// with poll_method = AA the data-IDs are added to the alternative list of the gateway after each connect.
+func (gw *otgwGateway) pollDataIDs() {
+	schedule := gw.pollSchedule()
+	if len(schedule) == 0 {
+		return
+	}
+
+	var ids []int
+	for id := range schedule {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	method := strings.ToUpper(gw.setting("poll_method"))
+	if method != "AA" {
+		method = "PM"
+	}
+	log.Printf("Polling data-IDs %v of otgw %s using %s\n", ids, gw.label(), method)
+
+	nextPoll := make(map[int]time.Time)
+	alternativesAdded := false
+
+	for {
+		time.Sleep(time.Second)
+
+		if !gw.isConnected() {
+			alternativesAdded = false
+			continue
+		}
+
+		if method == "AA" {
+			if !alternativesAdded {
+				for _, id := range ids {
+					gw.sendPollCommand(method, id)
+				}
+				alternativesAdded = true
+			}
+			continue
+		}
+
+		now := time.Now()
+		for _, id := range ids {
+			if now.Before(nextPoll[id]) {
+				continue
+			}
+			gw.sendPollCommand(method, id)
+			nextPoll[id] = now.Add(schedule[uint8(id)])
+		}
+	}
+}
+
+func (gw *otgwGateway) sendPollCommand(method string, id int) {
+	_, err := gw.SendCommand(method, fmt.Sprintf("%d", id))
+	if err != nil {
+		log.Printf("Could not request data-ID %d from otgw %s: %v\n", id, gw.label(), err)
+	} else {
+		logVerbose.Printf("Requested data-ID %d from otgw %s with %s\n", id, gw.label(), method)
+	}
+}
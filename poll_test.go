@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPollSchedule(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["poll_burner_starts"] = "3600"
+	config["poll_fhb_fault_index"] = "600"
+	config["poll_fhb_fault_value"] = "300"
+	config["boiler.poll_burner_starts"] = "60"
+
+	testTable := []struct {
+		device string
+		id     uint8
+		out    time.Duration
+	}{
+		{"", 116, time.Hour},
+		{"", 13, 5 * time.Minute},
+		{"", 120, 0},
+		{"boiler", 116, time.Minute},
+	}
+
+	for _, test := range testTable {
+		gw := &otgwGateway{name: test.device}
+		result := gw.pollSchedule()[test.id]
+		if result != test.out {
+			t.Errorf("pollSchedule(%s)[%d] failed: expected %v, got %v", test.device, test.id, test.out, result)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// protoBuffer encodes protobuf messages by hand, enough for the remote write and OTLP messages
+type protoBuffer []byte
+
+func (b *protoBuffer) varint(v uint64) {
+	*b = binary.AppendUvarint(*b, v)
+}
+
+func (b *protoBuffer) tag(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// bytes adds a length delimited field, also used for strings and embedded messages
+func (b *protoBuffer) bytes(field int, v []byte) {
+	b.tag(field, protoBytes)
+	b.varint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+// string adds a string field, empty strings are left out as in proto3
+func (b *protoBuffer) string(field int, v string) {
+	if len(v) > 0 {
+		b.bytes(field, []byte(v))
+	}
+}
+
+// int64 adds a varint field
+func (b *protoBuffer) int64(field int, v int64) {
+	if v != 0 {
+		b.tag(field, protoVarint)
+		b.varint(uint64(v))
+	}
+}
+
+// fixed64 adds a fixed64 field, used for timestamps in nanoseconds
+func (b *protoBuffer) fixed64(field int, v uint64) {
+	if v != 0 {
+		b.tag(field, protoFixed64)
+		*b = binary.LittleEndian.AppendUint64(*b, v)
+	}
+}
+
+// double adds a double field, unlike the other types a zero value is written so a value of 0 is
+// never lost in a oneof
+func (b *protoBuffer) double(field int, v float64) {
+	b.tag(field, protoFixed64)
+	*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+}
+
+// message adds an embedded message
+func (b *protoBuffer) message(field int, m protoBuffer) {
+	b.bytes(field, m)
+}
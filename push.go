@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockCommandValue formats a time for the SC command: HH:MM/D with 1 = monday .. 7 = sunday
+func clockCommandValue(t time.Time) string {
+	weekday := int(t.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	return fmt.Sprintf("%02d:%02d/%d", t.Hour(), t.Minute(), weekday)
+}
+
+// pushToGateway periodically sends the host clock (push_clock_interval) and the outside temperature
+// (push_outside_temperature_interval) to the gateway, which passes them on to the thermostat.
+func (gw *otgwGateway) pushToGateway(gateways []*otgwGateway) {
+	clockInterval := time.Duration(gw.settingInt("push_clock_interval", 0)) * time.Second
+	tempInterval := time.Duration(gw.settingInt("push_outside_temperature_interval", 0)) * time.Second
+	if clockInterval <= 0 && tempInterval <= 0 {
+		return
+	}
+
+	var nextClock, nextTemp time.Time
+
+	for {
+		time.Sleep(time.Second)
+		if !gw.isConnected() {
+			continue
+		}
+		now := time.Now()
+
+		if clockInterval > 0 && !now.Before(nextClock) {
+			nextClock = now.Add(clockInterval)
+			result, err := gw.SendCommand("SC", clockCommandValue(now))
+			if err != nil {
+				log.Printf("Could not set the clock of otgw %s: %v\n", gw.label(), err)
+			} else {
+				log.Printf("Set the clock of otgw %s to %s\n", gw.label(), result.Value)
+			}
+		}
+
+		if tempInterval > 0 && !now.Before(nextTemp) {
+			nextTemp = now.Add(tempInterval)
+			source := gw.setting("push_outside_temperature_source")
+			temp, err := outsideTemperature(source, gateways)
+			if err != nil {
+				log.Printf("Could not read the outside temperature from %s: %v\n", source, err)
+				continue
+			}
+			result, err := gw.SetOutsideTemperature(temp)
+			if err != nil {
+				log.Printf("Could not send outside temperature %.2f to otgw %s: %v\n", temp, gw.label(), err)
+			} else {
+				log.Printf("Sent outside temperature %.2f from %s to otgw %s\n", result, source, gw.label())
+			}
+		}
+	}
+}
+
+// outsideTemperature reads the temperature from a source:
+//   - file:<path>                a file containing the temperature
+//   - http://... or https://...  an endpoint returning the temperature as text or as json (see push_outside_temperature_json_field)
+//   - field:<name>[@<device>]    the last decoded value of a field, optionally from another gateway
+func outsideTemperature(source string, gateways []*otgwGateway) (float64, error) {
+	var value string
+
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return 0, err
+		}
+		value = string(data)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		data, err := httpGetValue(source)
+		if err != nil {
+			return 0, err
+		}
+		value = data
+	case strings.HasPrefix(source, "field:"):
+		field := strings.TrimPrefix(source, "field:")
+		device := ""
+		if at := strings.Index(field, "@"); at >= 0 {
+			field, device = field[:at], field[at+1:]
+		}
+		found := false
+		for _, gw := range gateways {
+			if len(device) == 0 || gw.name == device {
+				value, found = gw.latestValue(field, time.Hour)
+				if found {
+					break
+				}
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("no recent value for %s", field)
+		}
+	default:
+		return 0, fmt.Errorf("unknown source, use file:, http(s):// or field:")
+	}
+
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// httpGetValue fetches a value from an http endpoint. A json object response is searched for the
+// field set in push_outside_temperature_json_field (default: temperature)
+func httpGetValue(url string) (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("http request returned status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+
+	var obj map[string]interface{}
+	if json.Unmarshal(body, &obj) == nil {
+		field := config["push_outside_temperature_json_field"]
+		if len(field) == 0 {
+			field = "temperature"
+		}
+		v, ok := obj[field]
+		if !ok {
+			return "", fmt.Errorf("field %s not found in the json response", field)
+		}
+		return fmt.Sprintf("%v", v), nil
+	}
+	return string(body), nil
+}
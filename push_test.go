@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClockCommandValue(t *testing.T) {
+
+	testTable := []struct {
+		in  time.Time
+		out string
+	}{
+		{time.Date(2021, 12, 27, 8, 5, 0, 0, time.Local), "08:05/1"},
+		{time.Date(2021, 12, 26, 23, 59, 0, 0, time.Local), "23:59/7"},
+	}
+
+	for _, test := range testTable {
+		result := clockCommandValue(test.in)
+		if result != test.out {
+			t.Errorf("clockCommandValue(%v) failed: expected \"%s\", got \"%s\"", test.in, test.out, result)
+		}
+	}
+}
+
+func TestOutsideTemperature(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	fn := filepath.Join(t.TempDir(), "temp")
+	os.WriteFile(fn, []byte("12.5\n"), 0644)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"temperature": -3.25}`))
+	}))
+	defer server.Close()
+
+	gw := &otgwGateway{name: "ventilation"}
+	gw.OT.ParseMessage("B401B0A80")
+	gw.recordValues()
+
+	testTable := []struct {
+		source string
+		out    float64
+	}{
+		{"file:" + fn, 12.5},
+		{server.URL, -3.25},
+		{"field:outside_temperature@ventilation", 10.5},
+		{"field:outside_temperature", 10.5},
+	}
+
+	for _, test := range testTable {
+		result, err := outsideTemperature(test.source, []*otgwGateway{gw})
+		if err != nil || result != test.out {
+			t.Errorf("outsideTemperature(%s) failed: expected %.2f, got %.2f (%v)", test.source, test.out, result, err)
+		}
+	}
+
+	if _, err := outsideTemperature("field:outside_temperature@boiler", []*otgwGateway{gw}); err == nil {
+		t.Error("outsideTemperature failed: expected an error for an unknown device")
+	}
+}
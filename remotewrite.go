@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snappyEncode compresses data in the snappy block format used by the prometheus remote write protocol.
+// It is a simple greedy compressor, the repeating field names and labels compress well enough with it.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	table := make(map[uint32]int) // last position of every 4 byte sequence
+	literal := 0                  // start of the data not yet written
+
+	for i := 0; i+4 <= len(src); {
+		key := binary.LittleEndian.Uint32(src[i:])
+		candidate, ok := table[key]
+		table[key] = i
+		if !ok || i-candidate > 0xffff {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyLiteral(dst, src[literal:])
+}
+
+// snappyLiteral adds literal data in chunks of at most 64k
+func snappyLiteral(dst []byte, data []byte) []byte {
+	for len(data) > 0 {
+		n := len(data)
+		if n > 0x10000 {
+			n = 0x10000
+		}
+		switch l := n - 1; {
+		case l < 60:
+			dst = append(dst, byte(l)<<2)
+		case l < 0x100:
+			dst = append(dst, 60<<2, byte(l))
+		default:
+			dst = append(dst, 61<<2, byte(l), byte(l>>8))
+		}
+		dst = append(dst, data[:n]...)
+		data = data[n:]
+	}
+	return dst
+}
+
+// snappyCopy adds copies with a 2 byte offset, each copy is 4 to 64 bytes long
+func snappyCopy(dst []byte, offset int, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+			if length-n < 4 {
+				n = length - 4 // leave enough for a last copy of at least 4 bytes
+			}
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// remoteWriteSeries holds the samples of one time series in a batch
+type remoteWriteSeries struct {
+	labels     []string // name and value pairs sorted by name
+	values     []float64
+	timestamps []int64 // milliseconds
+}
+
+// remoteWriteSink pushes the fields as samples with the prometheus remote write protocol, e.g. to
+// VictoriaMetrics, Mimir or Thanos. Samples are collected in batches of remote_write_batch_size samples
+// or remote_write_flush_interval seconds. Events are not sent, remote write only carries samples.
+type remoteWriteSink struct {
+	name          string
+	url           string
+	client        *http.Client
+	prefix        string
+	batchSize     int
+	flushInterval time.Duration
+	series        map[string]*remoteWriteSeries
+	keys          []string // keeps the series in the order they were added
+	count         int
+	batchStarted  time.Time
+	sends         int // successful requests, see sinkBatcher
+}
+
+func newRemoteWriteSink(name string) (sink, error) {
+	if len(sinkSetting(name, "remote_write_url")) == 0 {
+		return nil, errors.New("remote_write_url is not set")
+	}
+	tlsConfig, err := buildTLSConfig(sinkSetting(name, "remote_write_tls_ca"), sinkSetting(name, "remote_write_tls_cert"),
+		sinkSetting(name, "remote_write_tls_key"), strings.Contains(sinkSetting(name, "remote_write_tls_insecure"), "YES"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &remoteWriteSink{
+		name: name,
+		url:  sinkSetting(name, "remote_write_url"),
+		client: &http.Client{
+			Timeout:   time.Duration(sinkSettingInt(name, "remote_write_timeout", 30)) * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		prefix:        sinkSetting(name, "remote_write_prefix"),
+		batchSize:     sinkSettingInt(name, "remote_write_batch_size", 500),
+		flushInterval: time.Duration(sinkSettingInt(name, "remote_write_flush_interval", 10)) * time.Second,
+		series:        make(map[string]*remoteWriteSeries),
+	}
+	if len(s.prefix) == 0 {
+		s.prefix = "otgw"
+	}
+	return s, nil
+}
+
+// pointLabels returns the labels of a field of a point, sorted by name
+func (s *remoteWriteSink) pointLabels(p otgwPoint, f otgwField) []string {
+	name, _ := metricName(s.prefix, p.msgID, f.name)
+	labels := map[string]string{"__name__": name, "data_id": strconv.Itoa(int(p.msgID)), "device": p.device}
+	for k, v := range p.tags {
+		labels[k] = v
+	}
+
+	names := make([]string, 0, len(labels))
+	for k, v := range labels {
+		if len(v) > 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var pairs []string
+	for _, k := range names {
+		pairs = append(pairs, k, labels[k])
+	}
+	return pairs
+}
+
+func (s *remoteWriteSink) writePoint(p otgwPoint) error {
+	for _, f := range p.fields {
+		value, err := f.float()
+		if err != nil || f.name == "reserved" {
+			continue
+		}
+		labels := s.pointLabels(p, f)
+		key := strings.Join(labels, "\x00")
+		series, ok := s.series[key]
+		if !ok {
+			series = &remoteWriteSeries{labels: labels}
+			s.series[key] = series
+			s.keys = append(s.keys, key)
+		}
+		if s.count == 0 {
+			s.batchStarted = time.Now()
+		}
+		series.values = append(series.values, value)
+		series.timestamps = append(series.timestamps, p.time.UnixMilli())
+		s.count++
+	}
+
+	if s.count >= s.batchSize {
+		return s.send()
+	}
+	return nil
+}
+
+func (s *remoteWriteSink) writeEvent(e otgwEvent) error {
+	return nil
+}
+
+func (s *remoteWriteSink) sent() int {
+	return s.sends
+}
+
+func (s *remoteWriteSink) flush(now time.Time) error {
+	if s.count > 0 && now.Sub(s.batchStarted) >= s.flushInterval {
+		return s.send()
+	}
+	return nil
+}
+
+func (s *remoteWriteSink) close() error {
+	if s.count > 0 {
+		return s.send()
+	}
+	return nil
+}
+
+// writeRequest encodes the batch as a prometheus WriteRequest message
+func (s *remoteWriteSink) writeRequest() []byte {
+	var request protoBuffer
+
+	for _, key := range s.keys {
+		series := s.series[key]
+		var ts protoBuffer
+		for i := 0; i < len(series.labels); i += 2 {
+			var label protoBuffer
+			label.string(1, series.labels[i])
+			label.string(2, series.labels[i+1])
+			ts.message(1, label)
+		}
+		for i := range series.values {
+			var sample protoBuffer
+			sample.double(1, series.values[i])
+			sample.int64(2, series.timestamps[i])
+			ts.message(2, sample)
+		}
+		request.message(1, ts)
+	}
+	return request
+}
+
+// send writes the batch and retries up to remote_write_retries times on network errors, 429 and 5xx.
+// The batch is dropped after the last attempt or when the server rejects it.
+func (s *remoteWriteSink) send() error {
+	body := snappyEncode(s.writeRequest())
+	samples := s.count
+	s.series = make(map[string]*remoteWriteSeries)
+	s.keys = nil
+	s.count = 0
+
+	retries := sinkSettingInt(s.name, "remote_write_retries", 3)
+	maxDelay := time.Duration(sinkSettingInt(s.name, "remote_write_retry_max_delay", 30)) * time.Second
+	delay := time.Second
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := s.post(body)
+		if err == nil {
+			logVerbose.Printf("Sent %d samples to %s\n", samples, s.url)
+			s.sends++
+			return nil
+		}
+		if retryAfter < 0 || attempt >= retries {
+			return fmt.Errorf("dropped %d samples: %v", samples, err)
+		}
+
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		logVerbose.Printf("Remote write failed, retrying in %v: %v\n", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends the compressed request. When it fails the returned duration is the delay requested by the
+// server, or -1 when the request must not be retried.
+func (s *remoteWriteSink) post(body []byte) (time.Duration, error) {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "otgw2db/"+sha1ver)
+	if token := sinkSetting(s.name, "remote_write_token"); len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := sinkSetting(s.name, "remote_write_user"); len(user) > 0 {
+		req.SetBasicAuth(user, sinkSetting(s.name, "remote_write_pass"))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return parseRetryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return -1, err
+}
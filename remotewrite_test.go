@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snappyDecode decompresses the snappy block format, it is used to check snappyEncode
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errors.New("invalid length")
+	}
+	src = src[n:]
+	var dst []byte
+
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 3 {
+		case 0:
+			l := int(tag >> 2)
+			src = src[1:]
+			switch l {
+			case 60:
+				l, src = int(src[0]), src[1:]
+			case 61:
+				l, src = int(src[0])|int(src[1])<<8, src[2:]
+			}
+			dst = append(dst, src[:l+1]...)
+			src = src[l+1:]
+		case 2:
+			l := int(tag>>2) + 1
+			offset := int(src[1]) | int(src[2])<<8
+			src = src[3:]
+			if offset == 0 || offset > len(dst) {
+				return nil, errors.New("invalid offset")
+			}
+			for i := 0; i < l; i++ {
+				dst = append(dst, dst[len(dst)-offset])
+			}
+		default:
+			return nil, errors.New("unexpected tag")
+		}
+	}
+	if uint64(len(dst)) != length {
+		return nil, errors.New("length mismatch")
+	}
+	return dst, nil
+}
+
+// protoFields returns the length delimited and fixed64/varint fields of a protobuf message
+func protoFields(b []byte) map[int][][]byte {
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case protoVarint:
+			_, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[:n])
+			b = b[n:]
+		case protoFixed64:
+			fields[field] = append(fields[field], b[:8])
+			b = b[8:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		}
+	}
+	return fields
+}
+
+func TestSnappyEncode(t *testing.T) {
+
+	testTable := []string{
+		"",
+		"abc",
+		strings.Repeat("otgw_boiler_water_temp", 100),
+		strings.Repeat("a", 70000),
+		strings.Repeat("0123456789", 10000) + "end",
+	}
+
+	for _, test := range testTable {
+		encoded := snappyEncode([]byte(test))
+		decoded, err := snappyDecode(encoded)
+		if err != nil || string(decoded) != test {
+			t.Errorf("snappyEncode(%d bytes) failed: %v", len(test), err)
+		}
+		if len(test) > 1000 && len(encoded) > len(test)/10 {
+			t.Errorf("snappyEncode(%d bytes) failed: no compression, got %d bytes", len(test), len(encoded))
+		}
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+
+	var lock sync.Mutex
+	var requests [][]byte
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		decoded, _ := snappyDecode(body)
+		requests = append(requests, decoded)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	readConfig("otgw2db.testing.cfg")
+	config["remote_write_url"] = server.URL
+	config["remote_write_token"] = "secret"
+	config["remote_write_retry_max_delay"] = "0"
+
+	s, err := newRemoteWriteSink("remote_write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Unix(1700000000, 0)
+	ot := openthermMessage{device: "home"}
+	for _, msg := range []string{"B40193C33", "B40193D00"} {
+		ot.ParseMessage(msg)
+		point, _ := ot.DecodeToPoint()
+		point.time = received
+		s.writePoint(point)
+		received = received.Add(time.Second)
+	}
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(requests) != 1 || attempts != 2 {
+		t.Fatalf("remote write failed: expected 1 request after a retry, got %d in %d attempts", len(requests), attempts)
+	}
+	series := protoFields(requests[0])[1]
+	if len(series) != 1 {
+		t.Fatalf("remote write failed: expected 1 series, got %d", len(series))
+	}
+
+	ts := protoFields(series[0])
+	var labels []string
+	for _, l := range ts[1] {
+		label := protoFields(l)
+		labels = append(labels, string(label[1][0])+"="+string(label[2][0]))
+	}
+	if strings.Join(labels, ",") != "__name__=otgw_boiler_water_temp,data_id=25,device=home" {
+		t.Errorf("remote write labels failed: got %v", labels)
+	}
+
+	testTable := []struct {
+		value     float64
+		timestamp int64
+	}{
+		{60.2, 1700000000000},
+		{61, 1700000001000},
+	}
+	for i, test := range testTable {
+		sample := protoFields(ts[2][i])
+		value := math.Float64frombits(binary.LittleEndian.Uint64(sample[1][0]))
+		timestamp, _ := binary.Uvarint(sample[2][0])
+		if math.Abs(value-test.value) > 0.01 || int64(timestamp) != test.timestamp {
+			t.Errorf("remote write sample %d failed: expected %v@%d, got %v@%d", i, test.value, test.timestamp, value, timestamp)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otgwField is a single decoded field of an OpenTherm message
+type otgwField struct {
+	name     string // name used in the store_ settings, e.g. boiler_water_temp
+	readable string // description for humans, e.g. Boiler water temperature
+	dataType uint8  // one of the cType constants, flags are cTypeFlag8 with a value of 0 or 1
+	value    string // value formatted as in the line protocol
+}
+
+// float returns the numeric value of the field
+func (f otgwField) float() (float64, error) {
+	return strconv.ParseFloat(f.value, 64)
+}
+
+// otgwPoint holds the decoded fields of one OpenTherm message, this is what the sinks receive
+type otgwPoint struct {
+	measurement string
+	device      string            // name of the gateway, empty for a single unnamed gateway
+	tags        map[string]string // additional tags, e.g. otgw_firmware
+	msgID       uint8
+	time        time.Time
+	fields      []otgwField
+}
+
+// selectFields returns a copy of the point with only the fields for which selected returns true
+func (p otgwPoint) selectFields(selected func(field string) bool) otgwPoint {
+	out := p
+	out.fields = nil
+	for _, f := range p.fields {
+		if selected(f.name) {
+			out.fields = append(out.fields, f)
+		}
+	}
+	return out
+}
+
+// tagString returns the device tag and the additional tags in line protocol format, e.g. ",device=home"
+func (p otgwPoint) tagString() string {
+	var output string
+
+	if len(p.device) > 0 {
+		output = fmt.Sprintf(",device=%s", escapeTag(p.device))
+	}
+	keys := make([]string, 0, len(p.tags))
+	for k := range p.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		output += fmt.Sprintf(",%s=%s", escapeTag(k), escapeTag(p.tags[k]))
+	}
+	return output
+}
+
+// lineProtocol returns the point in influx line protocol with the time in seconds, or an empty string when
+// it has no fields
+func (p otgwPoint) lineProtocol() string {
+	return p.lineProtocolPrecision(time.Second)
+}
+
+// lineProtocolPrecision returns the point in influx line protocol with the time in the given precision,
+// time.Second or time.Nanosecond
+func (p otgwPoint) lineProtocolPrecision(precision time.Duration) string {
+	var output, sep string = "", ""
+
+	for _, f := range p.fields {
+		output += fmt.Sprintf("%s%s=%s", sep, f.name, f.value)
+		sep = "," // prepare for a possible next field
+	}
+
+	if len(output) > 0 {
+		output = fmt.Sprintf("%s%s %s %d\n", p.measurement, p.tagString(), output, lineProtocolTime(p.time, precision))
+	}
+	return output
+}
+
+// lineProtocolTime returns the timestamp of a line in the given precision
+func lineProtocolTime(t time.Time, precision time.Duration) int64 {
+	if precision == time.Second {
+		return t.Unix()
+	}
+	return t.UnixNano() / int64(precision)
+}
+
+// readable returns the fields with their descriptions, one field per line
+func (p otgwPoint) readable() string {
+	var output, sep string = "", ""
+
+	for _, f := range p.fields {
+		output += fmt.Sprintf("%s%s: %s", sep, f.readable, f.value)
+		sep = "\n" // prepare for a possible next field
+	}
+	return output
+}
+
+// sink is an output for the decoded points and events. All methods of a sink are called from the
+// goroutine of its sinkRunner, a sink does not need locking of its own.
+type sink interface {
+	writePoint(p otgwPoint) error
+	writeEvent(e otgwEvent) error
+	close() error // flushes any buffered data when otgw2db stops
+}
+
+// sinkFlusher is implemented by sinks which collect data in batches. flush is called every second from
+// the goroutine of the sink, so a batch is also sent when no new data arrives.
+type sinkFlusher interface {
+	flush(now time.Time) error
+}
+
+// sinkBatcher is implemented by sinks which do not send every item when it is written, e.g. because
+// they collect a batch or skip unchanged values. sent returns the number of successful sends so far, a
+// failing sink is only considered to be writing again when it increased.
+type sinkBatcher interface {
+	sent() int
+}
+
+// sinkGatewayWatcher is implemented by sinks which report the state of the gateways and the other sinks,
+// watchGateways is called once from main after the gateways are created
+type sinkGatewayWatcher interface {
+	watchGateways(gateways []*otgwGateway, sinks sinkSet)
+}
+
+// sinkSelector is implemented by sinks which select their fields and events with their own settings
+// instead of the store_ and store_events settings
+type sinkSelector interface {
+	selectField(device string, field string) bool
+	selectEvent(e otgwEvent) bool
+}
+
+// sinkTypes creates a sink of a type given the name of the sink. A new backend only has to add its
+// constructor here, the name is used to read the settings of the sink with sinkSetting.
+var sinkTypes = map[string]func(name string) (sink, error){
+	"influx":       newInfluxSink,
+	"console":      newConsoleSink,
+	"mqtt":         newMQTTSink,
+	"remote_write": newRemoteWriteSink,
+	"otlp":         newOTLPSink,
+	"sql":          newSQLSink,
+	"file":         newFileSink,
+	"graphite":     newGraphiteSink,
+	"statsd":       newStatsDSink,
+	"socket":       newSocketSink,
+	"webhook":      newWebhookSink,
+}
+
+// sinkSetting returns <name>.<key> if it is set and otherwise the global setting key
+func sinkSetting(name string, key string) string {
+	if val, ok := config[name+"."+key]; ok {
+		return val
+	}
+	return config[key]
+}
+
+// sinkSettingInt returns the integer value of sinkSetting or def if the setting is missing or not a number
+func sinkSettingInt(name string, key string, def int) int {
+	val, err := strconv.Atoi(sinkSetting(name, key))
+	if err != nil {
+		return def
+	}
+	return val
+}
+
+// isSinkField checks if a field is stored by a sink. <sink>.store_<field> takes precedence over the
+// per device and global store_ settings.
+func isSinkField(name string, device string, field string) bool {
+	key := fmt.Sprintf("store_%s", field)
+	if val, ok := config[name+"."+key]; ok {
+		return strings.Contains(val, "YES")
+	}
+	return strings.Contains(deviceSetting(device, key), "YES")
+}
+
+// sinkNames returns the configured sinks. Without a sinks setting, or when it is empty, the sinks follow
+// the original decode_line_protocol and decode_readable settings.
+func sinkNames() []string {
+	var names []string
+
+	if len(strings.TrimSpace(config["sinks"])) > 0 {
+		for _, name := range strings.Split(config["sinks"], ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	if strings.Contains(config["decode_line_protocol"], "YES") {
+		names = append(names, "influx")
+	}
+	if strings.Contains(config["decode_readable"], "YES") {
+		names = append(names, "console")
+	}
+	return names
+}
+
+// sinkRunner delivers points and events to a sink from its own goroutine and queue, so a slow or
+// failing sink does not hold up the main loop or the other sinks
+type sinkRunner struct {
+	name  string
+	sink  sink
+	queue chan interface{} // otgwPoint or otgwEvent
+	done  chan struct{}
+
+	statsLock sync.Mutex
+	dropped   int
+	failed    int
+	lastError string // only a change of the error is logged, a sink that is down fails for every item
+}
+
+func newSinkRunner(name string, s sink) *sinkRunner {
+	r := &sinkRunner{
+		name:  name,
+		sink:  s,
+		queue: make(chan interface{}, sinkSettingInt(name, "sink_buffer", 1000)),
+		done:  make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *sinkRunner) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item, ok := <-r.queue:
+			if !ok {
+				r.stop()
+				return
+			}
+			r.deliver(item)
+		case now := <-ticker.C:
+			if _, ok := r.sink.(sinkFlusher); ok {
+				r.deliver(now)
+			}
+		}
+	}
+}
+
+// stop closes the sink after the queue is closed and empty
+func (r *sinkRunner) stop() {
+	if err := r.sink.close(); err != nil {
+		log.Printf("Could not close sink %s: %v\n", r.name, err)
+	}
+	close(r.done)
+}
+
+// deliver passes one item to the sink, errors and panics are logged and counted
+func (r *sinkRunner) deliver(item interface{}) {
+	defer func() {
+		if p := recover(); p != nil {
+			r.countFailure(fmt.Errorf("panic: %v", p))
+		}
+	}()
+
+	batcher, batching := r.sink.(sinkBatcher)
+	sent := 0
+	if batching {
+		sent = batcher.sent()
+	}
+
+	var err error
+	switch v := item.(type) {
+	case time.Time:
+		err = r.sink.(sinkFlusher).flush(v)
+	case otgwPoint:
+		err = r.sink.writePoint(v)
+	case otgwEvent:
+		err = r.sink.writeEvent(v)
+	}
+	if err != nil {
+		r.countFailure(err)
+		return
+	}
+
+	if batching && batcher.sent() == sent {
+		return // nothing was sent, so this does not tell whether the sink works again
+	}
+
+	r.statsLock.Lock()
+	recovered := len(r.lastError) > 0
+	r.lastError = ""
+	r.statsLock.Unlock()
+	if recovered {
+		log.Printf("Sink %s is writing again\n", r.name)
+	}
+}
+
+func (r *sinkRunner) countFailure(err error) {
+	r.statsLock.Lock()
+	r.failed++
+	repeated := r.lastError == err.Error()
+	r.lastError = err.Error()
+	r.statsLock.Unlock()
+
+	if repeated {
+		logVerbose.Printf("Sink %s failed: %v\n", r.name, err)
+	} else {
+		log.Printf("Sink %s failed: %v\n", r.name, err)
+	}
+}
+
+// counts returns the number of dropped and failed items
+func (r *sinkRunner) counts() (int, int) {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	return r.dropped, r.failed
+}
+
+// send queues an item without blocking, the oldest item is dropped when the queue is full
+func (r *sinkRunner) send(item interface{}) {
+	for {
+		select {
+		case r.queue <- item:
+			return
+		default:
+		}
+		select {
+		case <-r.queue: // dump value from channel
+			r.statsLock.Lock()
+			r.dropped++
+			r.statsLock.Unlock()
+		default:
+		}
+	}
+}
+
+// sinkSet fans out the points and events of the main loop to all sinks
+type sinkSet []*sinkRunner
+
+// startSinks creates the configured sinks, the type of a sink is <name>.type or the name itself
+func startSinks() sinkSet {
+	var sinks sinkSet
+
+	for _, name := range sinkNames() {
+		sinkType := name
+		if t, ok := config[name+".type"]; ok {
+			sinkType = strings.TrimSpace(t)
+		}
+		create, ok := sinkTypes[sinkType]
+		if !ok {
+			log.Fatalf("Unknown sink type %s for sink %s\n", sinkType, name)
+		}
+		s, err := create(name)
+		if err != nil {
+			log.Fatalf("Could not start sink %s: %v\n", name, err)
+		}
+		log.Printf("Writing to sink %s (%s)\n", name, sinkType)
+		sinks = append(sinks, newSinkRunner(name, s))
+	}
+	return sinks
+}
+
+// watchGateways passes the gateways to the sinks which report their state
+func (sinks sinkSet) watchGateways(gateways []*otgwGateway) {
+	for _, r := range sinks {
+		if w, ok := r.sink.(sinkGatewayWatcher); ok {
+			w.watchGateways(gateways, sinks)
+		}
+	}
+}
+
+// writePoint passes the fields selected by every sink to that sink
+func (sinks sinkSet) writePoint(p otgwPoint) {
+	for _, r := range sinks {
+		selected := p.selectFields(func(field string) bool {
+			if selector, ok := r.sink.(sinkSelector); ok {
+				return selector.selectField(p.device, field)
+			}
+			return isSinkField(r.name, p.device, field)
+		})
+		if len(selected.fields) > 0 {
+			r.send(selected)
+		}
+	}
+}
+
+// writeEvent passes an event to the sinks with store_events set or which select it themselves
+func (sinks sinkSet) writeEvent(e otgwEvent) {
+	for _, r := range sinks {
+		if selector, ok := r.sink.(sinkSelector); ok {
+			if selector.selectEvent(e) {
+				r.send(e)
+			}
+		} else if strings.Contains(sinkSetting(r.name, "store_events"), "YES") {
+			r.send(e)
+		}
+	}
+}
+
+// close stops all sinks and waits until they have flushed their data or the timeout has passed
+func (sinks sinkSet) close(timeout time.Duration) {
+	deadline := time.After(timeout)
+
+	for _, r := range sinks {
+		close(r.queue)
+	}
+	for _, r := range sinks {
+		select {
+		case <-r.done:
+		case <-deadline:
+			log.Printf("Timeout while flushing the data to sink %s\n", r.name)
+			return
+		}
+	}
+}
+
+// consoleSink prints the readable form of the points, as the decode_readable setting did before
+type consoleSink struct {
+	name string
+}
+
+func newConsoleSink(name string) (sink, error) {
+	return &consoleSink{name: name}, nil
+}
+
+func (s *consoleSink) writePoint(p otgwPoint) error {
+	readable := p.readable()
+	if len(p.device) > 0 {
+		readable = fmt.Sprintf("[%s] %s", p.device, strings.ReplaceAll(readable, "\n", fmt.Sprintf("\n[%s] ", p.device)))
+	}
+	fmt.Println(readable)
+	return nil
+}
+
+func (s *consoleSink) writeEvent(e otgwEvent) error {
+	output := fmt.Sprintf("%s: %s", e.name, e.state)
+	if len(e.detail) > 0 {
+		output += fmt.Sprintf(" (%s)", e.detail)
+	}
+	if len(e.device) > 0 {
+		output = fmt.Sprintf("[%s] %s", e.device, output)
+	}
+	fmt.Println(output)
+	return nil
+}
+
+func (s *consoleSink) close() error {
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps the fields it receives so the test can check the selection of every sink
+type recordingSink struct {
+	fields chan string
+	events chan string
+	fail   bool
+}
+
+func (s *recordingSink) writePoint(p otgwPoint) error {
+	if s.fail {
+		panic("sink failure")
+	}
+	for _, f := range p.fields {
+		s.fields <- f.name
+	}
+	return nil
+}
+
+func (s *recordingSink) writeEvent(e otgwEvent) error {
+	if s.fail {
+		return errors.New("sink failure")
+	}
+	s.events <- e.name
+	return nil
+}
+
+func (s *recordingSink) close() error {
+	close(s.fields)
+	close(s.events)
+	return nil
+}
+
+func TestSinkFanOut(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	recorders := make(map[string]*recordingSink)
+	sinkTypes["recording"] = func(name string) (sink, error) {
+		s := &recordingSink{fields: make(chan string, 100), events: make(chan string, 100), fail: name == "broken"}
+		recorders[name] = s
+		return s, nil
+	}
+	defer delete(sinkTypes, "recording")
+
+	config["sinks"] = "all, temperatures, broken"
+	config["all.type"] = "recording"
+	config["temperatures.type"] = "recording"
+	config["broken.type"] = "recording"
+	config["store_ch_enabled"] = "NO"
+	config["store_events"] = "NO"
+	config["all.store_events"] = "YES"
+	config["temperatures.store_ch_enabled"] = "YES"
+	config["temperatures.store_dhw_enabled"] = "NO"
+
+	sinks := startSinks()
+	if len(sinks) != 3 {
+		t.Fatalf("startSinks failed: expected 3 sinks, got %d", len(sinks))
+	}
+
+	ot := openthermMessage{}
+	for _, msg := range []string{"B40000200", "B40193C33"} {
+		ot.ParseMessage(msg)
+		point, _ := ot.DecodeToPoint()
+		sinks.writePoint(point)
+	}
+	sinks.writeEvent(otgwEvent{name: "connection", state: "connected", time: time.Now()})
+	sinks.close(time.Second)
+
+	testTable := []struct {
+		sink    string
+		stored  []string
+		skipped []string
+		events  int
+	}{
+		{"all", []string{"dhw_enabled", "flame_active", "boiler_water_temp"}, []string{"ch_enabled"}, 1},
+		{"temperatures", []string{"ch_enabled", "flame_active", "boiler_water_temp"}, []string{"dhw_enabled"}, 0},
+		{"broken", nil, []string{"boiler_water_temp"}, 0},
+	}
+
+	for _, test := range testTable {
+		fields := make(map[string]bool)
+		for f := range recorders[test.sink].fields {
+			fields[f] = true
+		}
+		for _, f := range test.stored {
+			if !fields[f] {
+				t.Errorf("sink %s failed: field %s was not stored", test.sink, f)
+			}
+		}
+		for _, f := range test.skipped {
+			if fields[f] {
+				t.Errorf("sink %s failed: field %s was stored", test.sink, f)
+			}
+		}
+		if len(recorders[test.sink].events) != test.events {
+			t.Errorf("sink %s failed: expected %d events, got %d", test.sink, test.events, len(recorders[test.sink].events))
+		}
+	}
+}
+
+func TestSinkNames(t *testing.T) {
+
+	testTable := []struct {
+		settings map[string]string
+		expected string
+	}{
+		{map[string]string{"decode_line_protocol": "YES", "decode_readable": "NO"}, "influx"},
+		{map[string]string{"decode_line_protocol": "YES", "decode_readable": "YES", "sinks": ""}, "influx,console"},
+		{map[string]string{"decode_line_protocol": "YES", "sinks": " mqtt, console "}, "mqtt,console"},
+	}
+
+	for _, test := range testTable {
+		readConfig("otgw2db.testing.cfg")
+		delete(config, "sinks")
+		for k, v := range test.settings {
+			config[k] = v
+		}
+		if names := strings.Join(sinkNames(), ","); names != test.expected {
+			t.Errorf("sinkNames(%v) failed: expected %s, got %s", test.settings, test.expected, names)
+		}
+	}
+}
+
+// batchingSink sends its points on flush, while down is set the batch is dropped
+type batchingSink struct {
+	pending int
+	down    bool
+	sends   int
+}
+
+func (s *batchingSink) writePoint(p otgwPoint) error {
+	s.pending++
+	return nil
+}
+
+func (s *batchingSink) writeEvent(e otgwEvent) error {
+	return nil
+}
+
+func (s *batchingSink) flush(now time.Time) error {
+	if s.pending == 0 {
+		return nil
+	}
+	s.pending = 0
+	if s.down {
+		return errors.New("sink failure")
+	}
+	s.sends++
+	return nil
+}
+
+func (s *batchingSink) sent() int {
+	return s.sends
+}
+
+func (s *batchingSink) close() error {
+	return nil
+}
+
+func TestSinkRecovery(t *testing.T) {
+
+	s := &batchingSink{down: true}
+	r := &sinkRunner{name: "batching", sink: s}
+
+	testTable := []struct {
+		item      interface{}
+		down      bool
+		lastError string
+	}{
+		{otgwPoint{}, true, ""},
+		{time.Now(), true, "sink failure"},
+		{time.Now(), false, "sink failure"},  // the batch is empty, nothing was sent
+		{otgwPoint{}, false, "sink failure"}, // only added to the batch
+		{time.Now(), false, ""},
+	}
+
+	for i, test := range testTable {
+		s.down = test.down
+		r.deliver(test.item)
+		if r.lastError != test.lastError {
+			t.Errorf("sink recovery failed at step %d: expected last error %q, got %q", i, test.lastError, r.lastError)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// socketWriter sends data to a tcp or udp address. A tcp connection is kept open between writes and
+// reopened after an error, with an increasing delay between the attempts.
+type socketWriter struct {
+	network  string // tcp or udp
+	address  string
+	maxDelay time.Duration
+	conn     net.Conn
+	attempt  int
+	retryAt  time.Time
+}
+
+func newSocketWriter(network string, address string, maxDelay time.Duration) (*socketWriter, error) {
+	network = strings.ToLower(network)
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("unknown protocol %s, use tcp or udp", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return &socketWriter{network: network, address: address, maxDelay: maxDelay}, nil
+}
+
+// write sends b, for udp b is a single datagram
+func (w *socketWriter) write(b []byte) error {
+	if w.conn == nil {
+		if time.Now().Before(w.retryAt) {
+			return fmt.Errorf("not connected to %s", w.address)
+		}
+		conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+		if err != nil {
+			w.attempt++
+			w.retryAt = time.Now().Add(reconnectDelay(w.attempt, w.maxDelay))
+			return err
+		}
+		w.conn = conn
+		w.attempt = 0
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := w.conn.Write(b)
+	if err != nil {
+		w.close()
+	}
+	return err
+}
+
+// writeLines sends lines, for udp they are combined in datagrams of at most maxPacket bytes
+func (w *socketWriter) writeLines(lines []string, maxPacket int) error {
+	if w.network == "tcp" {
+		return w.write([]byte(strings.Join(lines, "")))
+	}
+	for _, packet := range packets(lines, maxPacket) {
+		if err := w.write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *socketWriter) close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+// packets combines lines in packets of at most max bytes. A line is never split, a line longer than max
+// gets a packet of its own.
+func packets(lines []string, max int) [][]byte {
+	var result [][]byte
+	var packet []byte
+
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+len(line) > max {
+			result = append(result, packet)
+			packet = nil
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		result = append(result, packet)
+	}
+	return result
+}
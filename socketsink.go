@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// socketSink sends the points and events as line protocol over udp or tcp, e.g. to the socket_listener
+// input of Telegraf or the udp listener of InfluxDB 1.x. The lines are collected until the next line
+// would not fit in socket_max_packet bytes or for at most a second, over udp every packet holds only
+// complete lines.
+type socketSink struct {
+	name      string
+	writer    *socketWriter
+	maxPacket int
+	precision time.Duration // of the time in the lines, time.Second or time.Nanosecond
+	pending   []string
+	size      int
+	sends     int // successful writes of the pending lines, see sinkBatcher
+}
+
+func newSocketSink(name string) (sink, error) {
+	address := sinkSetting(name, "socket_address")
+	if len(address) == 0 {
+		return nil, fmt.Errorf("socket_address is not set")
+	}
+	protocol := strings.ToLower(sinkSetting(name, "socket_protocol"))
+	if len(protocol) == 0 {
+		protocol = "udp"
+	}
+	writer, err := newSocketWriter(protocol, address, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	maxPacket := 1432 // fits in the usual mtu of 1500 bytes
+	if protocol == "tcp" {
+		maxPacket = 65536
+	}
+	s := &socketSink{
+		name:      name,
+		writer:    writer,
+		maxPacket: sinkSettingInt(name, "socket_max_packet", maxPacket),
+	}
+	switch precision := sinkSetting(name, "socket_precision"); precision {
+	case "", "ns":
+		s.precision = time.Nanosecond
+	case "s":
+		s.precision = time.Second
+	default:
+		return nil, fmt.Errorf("unknown socket_precision %s, use ns or s", precision)
+	}
+	return s, nil
+}
+
+func (s *socketSink) writePoint(p otgwPoint) error {
+	return s.add(p.lineProtocolPrecision(s.precision))
+}
+
+func (s *socketSink) writeEvent(e otgwEvent) error {
+	return s.add(e.lineProtocolPrecision(s.precision))
+}
+
+// add queues a line and sends the queued lines first when the line does not fit in the packet
+func (s *socketSink) add(line string) error {
+	if len(line) == 0 {
+		return nil
+	}
+	var err error
+	if len(s.pending) > 0 && s.size+len(line) > s.maxPacket {
+		err = s.send()
+	}
+	s.pending = append(s.pending, line)
+	s.size += len(line)
+	return err
+}
+
+// send writes the queued lines, they are dropped when that fails
+func (s *socketSink) send() error {
+	lines := s.pending
+	s.pending = nil
+	s.size = 0
+	if err := s.writer.writeLines(lines, s.maxPacket); err != nil {
+		return err
+	}
+	s.sends++
+	return nil
+}
+
+func (s *socketSink) sent() int {
+	return s.sends
+}
+
+func (s *socketSink) flush(now time.Time) error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	return s.send()
+}
+
+func (s *socketSink) close() error {
+	err := s.flush(time.Now())
+	s.writer.close()
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSocketSink(t *testing.T) {
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	testTable := []struct {
+		protocol  string
+		address   string
+		precision string
+		timestamp string
+	}{
+		{"udp", udp.LocalAddr().String(), "", " 1700000000123456789"},
+		{"tcp", tcp.Addr().String(), "s", " 1700000000"},
+	}
+
+	for _, test := range testTable {
+		readConfig("otgw2db.testing.cfg")
+		config["socket_address"] = test.address
+		config["socket_protocol"] = test.protocol
+		config["socket_precision"] = test.precision
+		config["socket_max_packet"] = "200"
+
+		s, err := newSocketSink("socket")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ot := openthermMessage{device: "home"}
+		for i := 0; i < 5; i++ {
+			ot.ParseMessage("B40193C33")
+			point, _ := ot.DecodeToPoint()
+			point.time = time.Unix(1700000000, 123456789)
+			s.writePoint(point)
+		}
+		s.writeEvent(otgwEvent{device: "home", name: "connection", state: "connected", time: time.Unix(1700000000, 123456789)})
+		if err := s.close(); err != nil {
+			t.Fatalf("%s socket sink failed: %v", test.protocol, err)
+		}
+
+		var lines []string
+		if test.protocol == "udp" {
+			buf := make([]byte, 1500)
+			for len(lines) < 6 {
+				udp.SetReadDeadline(time.Now().Add(time.Second))
+				n, _, err := udp.ReadFrom(buf)
+				if err != nil {
+					t.Fatalf("udp socket sink failed: %v", err)
+				}
+				if n > 200 || buf[n-1] != '\n' {
+					t.Errorf("udp socket sink failed: packet of %d bytes does not end with a complete line", n)
+				}
+				lines = append(lines, strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")...)
+			}
+		} else {
+			conn, err := tcp.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			scanner := bufio.NewScanner(conn)
+			for len(lines) < 6 && scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			conn.Close()
+		}
+
+		if len(lines) != 6 {
+			t.Fatalf("%s socket sink failed: expected 6 lines, got %d", test.protocol, len(lines))
+		}
+		expected := "otgw,device=home boiler_water_temp=60.20" + test.timestamp
+		if lines[0] != expected {
+			t.Errorf("%s socket sink failed: expected %s, got %s", test.protocol, expected, lines[0])
+		}
+		if !strings.HasPrefix(lines[5], "otgw_events,event=connection,device=home ") || !strings.HasSuffix(lines[5], test.timestamp) {
+			t.Errorf("%s socket sink failed: unexpected event %s", test.protocol, lines[5])
+		}
+	}
+}
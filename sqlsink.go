@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // postgres, also used for TimescaleDB
+	_ "modernc.org/sqlite"             // pure go, so otgw2db can still be cross compiled without cgo
+)
+
+// sqlDialect holds the differences between the supported databases
+type sqlDialect struct {
+	driver      string // name of the database/sql driver
+	timeType    string
+	doubleType  string
+	placeholder func(n int) string // placeholder of the n-th argument, starting at 1
+	timeValue   func(t time.Time) interface{}
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"sqlite": {
+		driver:      "sqlite",
+		timeType:    "TEXT", // sqlite has no time type, the text format works with its date and time functions
+		doubleType:  "REAL",
+		placeholder: func(n int) string { return "?" },
+		timeValue:   func(t time.Time) interface{} { return t.UTC().Format("2006-01-02 15:04:05.000") },
+	},
+	"postgres": {
+		driver:      "pgx",
+		timeType:    "TIMESTAMPTZ",
+		doubleType:  "DOUBLE PRECISION",
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		timeValue:   func(t time.Time) interface{} { return t },
+	},
+}
+
+// names of the OpenTherm data types in the value_type column
+var sqlValueTypes = map[uint8]string{
+	cTypeU8:    "u8",
+	cTypeS8:    "s8",
+	cTypeF8_8:  "f8.8",
+	cTypeU16:   "u16",
+	cTypeS16:   "s16",
+	cTypeFlag8: "flag",
+}
+
+var sqlIdentifier = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// sqlSample is a row of the samples table
+type sqlSample struct {
+	time      time.Time
+	device    string
+	dataID    uint8
+	field     string
+	value     float64
+	valueType string
+}
+
+// sqlSink stores the fields in a table of typed samples and the events in a table of events, in SQLite
+// or PostgreSQL with optional TimescaleDB hypertables. The rows are inserted in batches of sql_batch_size
+// rows or after sql_flush_interval seconds, in a single transaction.
+type sqlSink struct {
+	name          string
+	db            *sql.DB
+	dialect       sqlDialect
+	samplesTable  string
+	eventsTable   string
+	batchSize     int
+	maxPending    int
+	flushInterval time.Duration
+	samples       []sqlSample
+	events        []otgwEvent
+	batchStarted  time.Time
+	retryAt       time.Time // no transaction is started before this time after an insert failed
+	inserts       int       // successful transactions, see sinkBatcher
+}
+
+func newSQLSink(name string) (sink, error) {
+	dialect, ok := sqlDialects[sinkSetting(name, "sql_driver")]
+	if !ok {
+		return nil, fmt.Errorf("unknown sql_driver %s, use sqlite or postgres", sinkSetting(name, "sql_driver"))
+	}
+	prefix := sinkSetting(name, "sql_table_prefix")
+	if len(prefix) == 0 {
+		prefix = "otgw"
+	}
+	if !sqlIdentifier.MatchString(prefix) {
+		return nil, fmt.Errorf("invalid sql_table_prefix %s", prefix)
+	}
+
+	db, err := sql.Open(dialect.driver, sinkSetting(name, "sql_dsn"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sqlSink{
+		name:          name,
+		db:            db,
+		dialect:       dialect,
+		samplesTable:  prefix + "_samples",
+		eventsTable:   prefix + "_events",
+		batchSize:     sinkSettingInt(name, "sql_batch_size", 100),
+		flushInterval: time.Duration(sinkSettingInt(name, "sql_flush_interval", 10)) * time.Second,
+	}
+	s.maxPending = sinkSettingInt(name, "sql_max_pending", 100*s.batchSize)
+
+	err = s.createSchema(strings.Contains(sinkSetting(name, "sql_timescale"), "YES"))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// createSchema creates the tables and indexes when they do not exist yet
+func (s *sqlSink) createSchema(timescale bool) error {
+	statements := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	time %s NOT NULL,
+	device TEXT NOT NULL,
+	data_id INTEGER NOT NULL,
+	field TEXT NOT NULL,
+	value %s NOT NULL,
+	value_type TEXT NOT NULL
+)`, s.samplesTable, s.dialect.timeType, s.dialect.doubleType),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_field_time ON %s (field, time)", s.samplesTable, s.samplesTable),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_device_time ON %s (device, time)", s.samplesTable, s.samplesTable),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	time %s NOT NULL,
+	device TEXT NOT NULL,
+	event TEXT NOT NULL,
+	state TEXT NOT NULL,
+	detail TEXT NOT NULL
+)`, s.eventsTable, s.dialect.timeType),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_time ON %s (time)", s.eventsTable, s.eventsTable),
+	}
+	if timescale {
+		for _, table := range []string{s.samplesTable, s.eventsTable} {
+			statements = append(statements, fmt.Sprintf("SELECT create_hypertable('%s', 'time', if_not_exists => TRUE)", table))
+		}
+	}
+
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return fmt.Errorf("could not create the schema: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqlSink) writePoint(p otgwPoint) error {
+	for _, f := range p.fields {
+		value, err := f.float()
+		if err != nil || f.name == "reserved" {
+			continue
+		}
+		s.startBatch()
+		s.samples = append(s.samples, sqlSample{time: p.time, device: p.device, dataID: p.msgID, field: f.name, value: value, valueType: sqlValueTypes[f.dataType]})
+	}
+	if len(s.samples)+len(s.events) >= s.batchSize && !time.Now().Before(s.retryAt) {
+		return s.insert()
+	}
+	return nil
+}
+
+func (s *sqlSink) writeEvent(e otgwEvent) error {
+	s.startBatch()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *sqlSink) startBatch() {
+	if len(s.samples)+len(s.events) == 0 {
+		s.batchStarted = time.Now()
+	}
+}
+
+func (s *sqlSink) sent() int {
+	return s.inserts
+}
+
+func (s *sqlSink) flush(now time.Time) error {
+	if len(s.samples)+len(s.events) > 0 && now.Sub(s.batchStarted) >= s.flushInterval && !now.Before(s.retryAt) {
+		return s.insert()
+	}
+	return nil
+}
+
+func (s *sqlSink) close() error {
+	var err error
+	if len(s.samples)+len(s.events) > 0 {
+		err = s.insert()
+	}
+	s.db.Close()
+	return err
+}
+
+// insert writes the pending rows in one transaction. When that fails the rows are kept for the next
+// attempt, up to sql_max_pending rows after which the oldest are dropped.
+func (s *sqlSink) insert() error {
+	err := s.insertRows()
+	if err == nil {
+		s.samples = nil
+		s.events = nil
+		s.inserts++
+		return nil
+	}
+
+	if excess := len(s.samples) - s.maxPending; excess > 0 {
+		log.Printf("Sink %s: dropped the %d oldest samples\n", s.name, excess)
+		s.samples = s.samples[excess:]
+	}
+	if excess := len(s.events) - s.maxPending; excess > 0 {
+		s.events = s.events[excess:]
+	}
+	s.retryAt = time.Now().Add(s.flushInterval) // wait another flush interval before trying again
+	return err
+}
+
+func (s *sqlSink) insertRows() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // does nothing after a commit
+
+	if len(s.samples) > 0 {
+		stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (time, device, data_id, field, value, value_type) VALUES (%s)", s.samplesTable, s.placeholders(6)))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, row := range s.samples {
+			_, err = stmt.Exec(s.dialect.timeValue(row.time), row.device, int(row.dataID), row.field, row.value, row.valueType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(s.events) > 0 {
+		stmt, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (time, device, event, state, detail) VALUES (%s)", s.eventsTable, s.placeholders(5)))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range s.events {
+			_, err = stmt.Exec(s.dialect.timeValue(e.time), e.device, e.name, e.state, e.detail)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.New("commit failed: " + err.Error())
+	}
+	logVerbose.Printf("Inserted %d samples and %d events in %s\n", len(s.samples), len(s.events), s.name)
+	return nil
+}
+
+// placeholders returns the placeholders for n arguments, e.g. ?, ?, ? or $1, $2, $3
+func (s *sqlSink) placeholders(n int) string {
+	var p []string
+	for i := 1; i <= n; i++ {
+		p = append(p, s.dialect.placeholder(i))
+	}
+	return strings.Join(p, ", ")
+}
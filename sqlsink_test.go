@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingDriver is a database/sql driver which records the executed statements
+type recordingDriver struct {
+	lock       sync.Mutex
+	statements []string
+	rows       map[string]int // inserted rows by table
+	failCommit bool
+}
+
+type recordingConn struct{ d *recordingDriver }
+type recordingStmt struct {
+	d     *recordingDriver
+	query string
+}
+type recordingTx struct{ d *recordingDriver }
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) { return &recordingConn{d}, nil }
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{c.d, query}, nil
+}
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return &recordingTx{c.d}, nil }
+func (s *recordingStmt) Close() error              { return nil }
+func (s *recordingStmt) NumInput() int             { return -1 }
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.lock.Lock()
+	defer s.d.lock.Unlock()
+	s.d.statements = append(s.d.statements, s.query)
+	if strings.HasPrefix(s.query, "INSERT INTO ") {
+		s.d.rows[strings.Fields(s.query)[2]]++
+	}
+	return driver.RowsAffected(1), nil
+}
+func (tx *recordingTx) Commit() error {
+	if tx.d.failCommit {
+		return errors.New("database is locked")
+	}
+	return nil
+}
+func (tx *recordingTx) Rollback() error { return nil }
+
+var testDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("otgw2db_recording", testDriver)
+}
+
+func TestSQLSink(t *testing.T) {
+
+	sqlDialects["recording"] = sqlDialect{
+		driver:      "otgw2db_recording",
+		timeType:    "TIMESTAMPTZ",
+		doubleType:  "DOUBLE PRECISION",
+		placeholder: sqlDialects["postgres"].placeholder,
+		timeValue:   sqlDialects["postgres"].timeValue,
+	}
+	defer delete(sqlDialects, "recording")
+	testDriver.statements = nil
+	testDriver.rows = make(map[string]int)
+
+	readConfig("otgw2db.testing.cfg")
+	config["sql_driver"] = "recording"
+	config["sql_timescale"] = "YES"
+	config["sql_batch_size"] = "1000"
+
+	s, err := newSQLSink("sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ot := openthermMessage{device: "home"}
+	for _, msg := range []string{"B40193C33", "B40000200"} {
+		ot.ParseMessage(msg)
+		point, _ := ot.DecodeToPoint()
+		s.writePoint(point)
+	}
+	s.writeEvent(otgwEvent{device: "home", name: "connection", state: "connected", time: time.Now()})
+
+	// a failed transaction keeps the rows for the next attempt
+	testDriver.failCommit = true
+	if err := s.(*sqlSink).flush(time.Now().Add(time.Minute)); err == nil {
+		t.Errorf("sql sink failed: expected an error when the commit fails")
+	}
+	testDriver.failCommit = false
+	testDriver.rows = make(map[string]int)
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testTable := []struct {
+		statement string
+		count     int
+	}{
+		{"CREATE TABLE IF NOT EXISTS otgw_samples", 1},
+		{"CREATE TABLE IF NOT EXISTS otgw_events", 1},
+		{"SELECT create_hypertable('otgw_samples', 'time', if_not_exists => TRUE)", 1},
+		{"INSERT INTO otgw_samples (time, device, data_id, field, value, value_type) VALUES ($1, $2, $3, $4, $5, $6)", 34},
+	}
+	for _, test := range testTable {
+		count := 0
+		for _, statement := range testDriver.statements {
+			if strings.HasPrefix(statement, test.statement) {
+				count++
+			}
+		}
+		if count != test.count {
+			t.Errorf("sql sink failed: expected %d times %s, got %d", test.count, test.statement, count)
+		}
+	}
+
+	// 1 temperature and 16 flags, written in the failed and the successful transaction
+	if testDriver.rows["otgw_samples"] != 17 || testDriver.rows["otgw_events"] != 1 {
+		t.Errorf("sql sink failed: expected 17 samples and 1 event, got %v", testDriver.rows)
+	}
+}
+
+func TestSQLSinkRetry(t *testing.T) {
+
+	sqlDialects["recording"] = sqlDialect{
+		driver:      "otgw2db_recording",
+		timeType:    "TIMESTAMPTZ",
+		doubleType:  "DOUBLE PRECISION",
+		placeholder: sqlDialects["postgres"].placeholder,
+		timeValue:   sqlDialects["postgres"].timeValue,
+	}
+	defer delete(sqlDialects, "recording")
+	testDriver.rows = make(map[string]int)
+
+	readConfig("otgw2db.testing.cfg")
+	config["sql_driver"] = "recording"
+	config["sql_batch_size"] = "2"
+	config["sql_flush_interval"] = "10"
+
+	s, err := newSQLSink("sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	ot := openthermMessage{device: "home"}
+	ot.ParseMessage("B40193C33")
+	point, _ := ot.DecodeToPoint()
+
+	// while the database is down a full batch does not start a transaction for every point
+	testDriver.failCommit = true
+	defer func() { testDriver.failCommit = false }()
+	testTable := []struct {
+		write   bool
+		now     time.Time
+		failed  bool
+		samples int
+	}{
+		{true, time.Time{}, false, 0},
+		{true, time.Time{}, true, 2},
+		{true, time.Time{}, false, 2},
+		{true, time.Time{}, false, 2},
+		{false, time.Now(), false, 2},
+		{false, time.Now().Add(time.Minute), true, 6},
+	}
+
+	for i, test := range testTable {
+		if test.write {
+			err = s.writePoint(point)
+		} else {
+			err = s.(*sqlSink).flush(test.now)
+		}
+		if (err != nil) != test.failed || testDriver.rows["otgw_samples"] != test.samples {
+			t.Errorf("sql sink retry failed at step %d: expected error %v and %d inserted samples, got %v and %d", i, test.failed, test.samples, err, testDriver.rows["otgw_samples"])
+		}
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["sql_driver"] = "sqlite"
+	config["sql_dsn"] = filepath.Join(t.TempDir(), "otgw2db.sqlite")
+
+	s, err := newSQLSink("sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot := openthermMessage{device: "home"}
+	ot.ParseMessage("B40193C33")
+	point, _ := ot.DecodeToPoint()
+	s.writePoint(point)
+	s.writeEvent(otgwEvent{device: "home", name: "connection", state: "connected", time: time.Now()})
+	if err := s.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second start finds the existing tables
+	s, err = newSQLSink("sql")
+	if err != nil {
+		t.Fatalf("sqlite sink failed on an existing database: %v", err)
+	}
+	s.close()
+
+	db, err := sql.Open("sqlite", config["sql_dsn"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var field, valueType string
+	var value float64
+	err = db.QueryRow("SELECT field, value, value_type FROM otgw_samples WHERE device = 'home' AND data_id = 25").Scan(&field, &value, &valueType)
+	if err != nil || field != "boiler_water_temp" || value != 60.2 || valueType != "f8.8" {
+		t.Errorf("sqlite sink failed: got %s = %v (%s), %v", field, value, valueType, err)
+	}
+	var state string
+	err = db.QueryRow("SELECT state FROM otgw_events WHERE event = 'connection'").Scan(&state)
+	if err != nil || state != "connected" {
+		t.Errorf("sqlite sink failed: expected the connection event, got %s, %v", state, err)
+	}
+}
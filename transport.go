@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialTransport opens a connection to the gateway using the transport selected with otgw_transport:
+//   - tcp:     plain tcp connection (default)
+//   - tls:     tls connection, e.g. to stunnel in front of the gateway
+//   - rfc2217: telnet connection to a serial-over-network bridge like ser2net
+func (gw *otgwGateway) dialTransport(d *net.Dialer) (net.Conn, error) {
+	switch strings.ToLower(gw.setting("otgw_transport")) {
+	case "", "tcp":
+		return d.Dial("tcp", gw.address)
+	case "tls":
+		tlsConfig, err := gw.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.DialWithDialer(d, "tcp", gw.address, tlsConfig)
+	case "rfc2217":
+		conn, err := d.Dial("tcp", gw.address)
+		if err != nil {
+			return nil, err
+		}
+		tc, err := newTelnetConn(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+	return nil, fmt.Errorf("unknown otgw_transport %s, use tcp, tls or rfc2217", gw.setting("otgw_transport"))
+}
+
+// tlsConfig builds the tls configuration from otgw_tls_ca, otgw_tls_cert, otgw_tls_key and otgw_tls_insecure
+func (gw *otgwGateway) tlsConfig() (*tls.Config, error) {
+	return buildTLSConfig(gw.setting("otgw_tls_ca"), gw.setting("otgw_tls_cert"), gw.setting("otgw_tls_key"),
+		strings.Contains(gw.setting("otgw_tls_insecure"), "YES"))
+}
+
+// buildTLSConfig creates a tls configuration with an optional CA file and client certificate
+func buildTLSConfig(caFile string, certFile string, keyFile string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecure}
+
+	if len(caFile) > 0 {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(certFile) > 0 || len(keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// telnet protocol bytes (RFC 854) and the com port option (RFC 2217)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+
+	telnetOptBinary  = 0
+	telnetOptSGA     = 3 // suppress go ahead
+	telnetOptComPort = 44
+	comPortSetBaud   = 1
+	comPortSetData   = 2
+	comPortSetParity = 3
+	comPortSetStop   = 4
+)
+
+// telnetConn removes the telnet negotiation from the data stream of an RFC 2217 bridge so the IAC
+// sequences never reach ParseMessage. The bridge is asked to set the serial port to 9600 8N1 as
+// required by the OTGW.
+type telnetConn struct {
+	net.Conn
+	writeLock sync.Mutex
+	state     int // position in a telnet sequence, see Read
+	option    byte
+}
+
+const (
+	telnetStateData = iota
+	telnetStateIAC
+	telnetStateOption
+	telnetStateSub
+	telnetStateSubIAC
+)
+
+func newTelnetConn(conn net.Conn) (*telnetConn, error) {
+	tc := &telnetConn{Conn: conn}
+
+	negotiation := []byte{
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptBinary,
+		telnetIAC, telnetWILL, telnetOptSGA,
+		telnetIAC, telnetDO, telnetOptSGA,
+		telnetIAC, telnetWILL, telnetOptComPort,
+	}
+	negotiation = append(negotiation, comPortCommand(comPortSetBaud, 0, 0, 0x25, 0x80)...) // 9600 baud
+	negotiation = append(negotiation, comPortCommand(comPortSetData, 8)...)
+	negotiation = append(negotiation, comPortCommand(comPortSetParity, 1)...) // none
+	negotiation = append(negotiation, comPortCommand(comPortSetStop, 1)...)
+
+	return tc, tc.writeRaw(negotiation)
+}
+
+func comPortCommand(command byte, value ...byte) []byte {
+	cmd := []byte{telnetIAC, telnetSB, telnetOptComPort, command}
+	for _, v := range value {
+		cmd = append(cmd, v)
+		if v == telnetIAC {
+			cmd = append(cmd, telnetIAC)
+		}
+	}
+	return append(cmd, telnetIAC, telnetSE)
+}
+
+func (tc *telnetConn) writeRaw(b []byte) error {
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+	tc.Conn.SetWriteDeadline(time.Now().Add(time.Second * 2))
+	_, err := tc.Conn.Write(b)
+	return err
+}
+
+// Write escapes IAC bytes in the data written to the gateway
+func (tc *telnetConn) Write(b []byte) (int, error) {
+	escaped := make([]byte, 0, len(b))
+	for _, c := range b {
+		escaped = append(escaped, c)
+		if c == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+
+	tc.writeLock.Lock()
+	defer tc.writeLock.Unlock()
+	_, err := tc.Conn.Write(escaped)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the data received from the gateway with all telnet commands removed. Option requests
+// from the bridge for options we did not offer ourselves are refused.
+func (tc *telnetConn) Read(b []byte) (int, error) {
+	for {
+		n, err := tc.Conn.Read(b)
+
+		// the data is filtered in place, out never passes the current position
+		out := 0
+		for _, c := range b[:n] {
+			switch tc.state {
+			case telnetStateData:
+				if c == telnetIAC {
+					tc.state = telnetStateIAC
+				} else {
+					b[out] = c
+					out++
+				}
+			case telnetStateIAC:
+				switch c {
+				case telnetIAC: // escaped 255 data byte
+					b[out] = c
+					out++
+					tc.state = telnetStateData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					tc.option = c
+					tc.state = telnetStateOption
+				case telnetSB:
+					tc.state = telnetStateSub
+				default:
+					tc.state = telnetStateData
+				}
+			case telnetStateOption:
+				tc.answerOption(tc.option, c)
+				tc.state = telnetStateData
+			case telnetStateSub:
+				// com port responses (e.g. the confirmed baud rate) are ignored
+				if c == telnetIAC {
+					tc.state = telnetStateSubIAC
+				}
+			case telnetStateSubIAC:
+				if c == telnetSE {
+					tc.state = telnetStateData
+				} else {
+					tc.state = telnetStateSub
+				}
+			}
+		}
+
+		// only return when there is data or an error, a read with only telnet commands is not an EOF
+		if out > 0 || err != nil {
+			if err != nil && out > 0 {
+				return out, nil
+			}
+			return out, err
+		}
+	}
+}
+
+func (tc *telnetConn) answerOption(request byte, option byte) {
+	if option == telnetOptBinary || option == telnetOptSGA || option == telnetOptComPort {
+		return // these were requested in newTelnetConn, answering again would start a negotiation loop
+	}
+
+	var answer byte
+	switch request {
+	case telnetDO:
+		answer = telnetWONT
+	case telnetWILL:
+		answer = telnetDONT
+	default:
+		return // WONT and DONT need no answer
+	}
+	if err := tc.writeRaw([]byte{telnetIAC, answer, option}); err != nil {
+		logVerbose.Println("Could not answer telnet option: ", err)
+	}
+}
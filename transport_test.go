@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTelnetConn(t *testing.T) {
+
+	client, server := net.Pipe()
+	received := make(chan []byte, 10)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- append([]byte{}, buf[:n]...)
+		}
+	}()
+
+	tc, err := newTelnetConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	negotiation := <-received
+	if !bytes.Contains(negotiation, []byte{telnetIAC, telnetSB, telnetOptComPort, comPortSetBaud, 0, 0, 0x25, 0x80, telnetIAC, telnetSE}) {
+		t.Errorf("newTelnetConn failed: baud rate not requested in % x", negotiation)
+	}
+
+	go func() {
+		server.Write([]byte("T800"))
+		server.Write([]byte{telnetIAC, telnetDO, 24}) // terminal type, must be refused
+		server.Write([]byte{telnetIAC, telnetSB, telnetOptComPort, comPortSetBaud + 100, 0, 0, 0x25, 0x80, telnetIAC, telnetSE})
+		server.Write([]byte("00200\r\n"))
+	}()
+
+	tc.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(tc).ReadString('\n')
+	if err != nil || line != "T80000200\r\n" {
+		t.Errorf("telnetConn.Read failed: expected \"T80000200\", got \"%q\" (%v)", line, err)
+	}
+
+	select {
+	case answer := <-received:
+		if !bytes.Equal(answer, []byte{telnetIAC, telnetWONT, 24}) {
+			t.Errorf("telnetConn.Read failed: expected WONT 24, got % x", answer)
+		}
+	case <-time.After(time.Second):
+		t.Error("telnetConn.Read failed: unsupported option was not refused")
+	}
+
+	go tc.Write([]byte{'A', telnetIAC})
+	if escaped := <-received; !bytes.Equal(escaped, []byte{'A', telnetIAC, telnetIAC}) {
+		t.Errorf("telnetConn.Write failed: expected escaped IAC, got % x", escaped)
+	}
+}
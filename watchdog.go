@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the two sides of the OpenTherm bus watched by the watchdog, keyed by the first character of an OTGW message
+var busSides = map[byte]string{
+	'T': "thermostat",
+	'B': "boiler",
+}
+
+// busWatchdog tracks when the last valid frame was received from the thermostat and the boiler
+type busWatchdog struct {
+	sync.Mutex
+	lastFrame map[string]time.Time
+	silent    map[string]bool
+}
+
+// init creates the maps of the watchdog, the caller holds the lock
+func (wd *busWatchdog) init() {
+	if wd.lastFrame == nil {
+		wd.lastFrame = make(map[string]time.Time)
+		wd.silent = make(map[string]bool)
+	}
+}
+
+// frameReceived records a valid frame, msg is the raw message from the gateway
+func (gw *otgwGateway) frameReceived(msg string) {
+	side, ok := busSides[msg[0]]
+	if !ok {
+		return
+	}
+
+	gw.watchdog.Lock()
+	gw.watchdog.init()
+	gw.watchdog.lastFrame[side] = time.Now()
+	wasSilent := gw.watchdog.silent[side]
+	gw.watchdog.silent[side] = false
+	gw.watchdog.Unlock()
+
+	if wasSilent {
+		log.Printf("OpenTherm traffic from the %s on otgw %s has resumed\n", side, gw.label())
+		publishEvent(gw, side+"_silent", "ok", "frames are received again")
+	}
+}
+
+// checkWatchdog raises an event when the thermostat or the boiler has not sent a valid frame for longer
+// than watchdog_thermostat_timeout or watchdog_boiler_timeout seconds. Silence is only measured while
+// the gateway is connected, a lost connection is reported by the connection events.
+func (gw *otgwGateway) checkWatchdog(now time.Time) {
+	connectedSince := gw.connStats().ConnectedSince
+	if !gw.isConnected() {
+		return
+	}
+
+	for _, side := range busSides {
+		timeout := time.Duration(gw.settingInt(fmt.Sprintf("watchdog_%s_timeout", side), 60)) * time.Second
+		if timeout <= 0 {
+			continue
+		}
+
+		gw.watchdog.Lock()
+		gw.watchdog.init()
+		last := gw.watchdog.lastFrame[side]
+		if last.Before(connectedSince) {
+			last = connectedSince
+		}
+		raise := now.Sub(last) > timeout && !gw.watchdog.silent[side]
+		if raise {
+			gw.watchdog.silent[side] = true
+		}
+		gw.watchdog.Unlock()
+
+		if raise {
+			detail := fmt.Sprintf("no valid frame for %v", now.Sub(last).Round(time.Second))
+			log.Printf("The %s on otgw %s is silent: %s\n", side, gw.label(), detail)
+			publishEvent(gw, side+"_silent", "silent", detail)
+		}
+	}
+}
+
+// gatewayHealth is the state of a gateway as reported by the health endpoint
+type gatewayHealth struct {
+	Device           string    `json:"device,omitempty"`
+	Address          string    `json:"address"`
+	Connection       string    `json:"connection"`
+	LastThermostat   time.Time `json:"last_thermostat_frame"`
+	LastBoiler       time.Time `json:"last_boiler_frame"`
+	ThermostatSilent bool      `json:"thermostat_silent"`
+	BoilerSilent     bool      `json:"boiler_silent"`
+	Firmware         string    `json:"firmware,omitempty"`
+	Mode             string    `json:"mode,omitempty"`
+}
+
+func (gw *otgwGateway) health() gatewayHealth {
+	h := gatewayHealth{Device: gw.name, Address: gw.address, Connection: gw.connStats().State}
+	h.Firmware = gw.identityValue("firmware")
+	h.Mode = gw.identityValue("mode")
+
+	gw.watchdog.Lock()
+	h.LastThermostat = gw.watchdog.lastFrame["thermostat"]
+	h.LastBoiler = gw.watchdog.lastFrame["boiler"]
+	h.ThermostatSilent = gw.watchdog.silent["thermostat"]
+	h.BoilerSilent = gw.watchdog.silent["boiler"]
+	gw.watchdog.Unlock()
+
+	return h
+}
+
+func (h gatewayHealth) ok() bool {
+	return h.Connection == connStateConnected && !h.ThermostatSilent && !h.BoilerSilent
+}
+
+// healthHandler reports the connection and bus state of all gateways. The status is 503 when any
+// gateway is disconnected or silent so it can be used directly by monitoring tools.
+func healthHandler(gateways []*otgwGateway) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var report []gatewayHealth
+		status := http.StatusOK
+
+		for _, gw := range gateways {
+			h := gw.health()
+			if !h.ok() {
+				status = http.StatusServiceUnavailable
+			}
+			report = append(report, h)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+
+	readConfig("otgw2db.testing.cfg")
+	config["watchdog_thermostat_timeout"] = "60"
+	config["watchdog_boiler_timeout"] = "120"
+
+	gw := &otgwGateway{address: "test"}
+	conn, _ := net.Pipe()
+	gw.setConnection(conn)
+	gw.setState(connStateConnected, "test")
+	gw.frameReceived("T80000200")
+	gw.frameReceived("B40000200")
+
+	testTable := []struct {
+		after            time.Duration
+		thermostatSilent bool
+		boilerSilent     bool
+	}{
+		{30 * time.Second, false, false},
+		{90 * time.Second, true, false},
+		{150 * time.Second, true, true},
+	}
+
+	for _, test := range testTable {
+		gw.checkWatchdog(time.Now().Add(test.after))
+		h := gw.health()
+		if h.ThermostatSilent != test.thermostatSilent || h.BoilerSilent != test.boilerSilent {
+			t.Errorf("checkWatchdog(+%v) failed: expected silent %v/%v, got %v/%v", test.after, test.thermostatSilent, test.boilerSilent, h.ThermostatSilent, h.BoilerSilent)
+		}
+	}
+
+	gw.frameReceived("T80000200")
+	if gw.health().ThermostatSilent {
+		t.Error("frameReceived failed: thermostat still silent after a new frame")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// default fields of which a change is posted: the fault and service flags and the fault code
+const webhookDefaultFields = "fault_indication, diagnostic_event, service_required, remote_reset_enabled, low_water_pressure_fault, gas_flame_fault, air_pressure_fault, water_over_temperture_fault, oem_fault_code"
+
+const webhookDefaultTemplate = `{"device": "{device}", "event": "{event}", "state": "{state}", "previous": "{previous}", "detail": "{detail}", "time": "{time}", "message": "{message}"}`
+
+// webhookNotification is an event or the change of a field, as it is filled in in the template
+type webhookNotification struct {
+	device   string
+	event    string // name of the event or field
+	state    string // new state or value
+	previous string // previous value of a field
+	detail   string // detail of an event, readable name of a field
+	field    bool
+	time     time.Time
+}
+
+// message is a short readable description, e.g. [home] Fault indication: 1 (was 0)
+func (n webhookNotification) message() string {
+	output := fmt.Sprintf("%s: %s", n.event, n.state)
+	switch {
+	case n.field && len(n.detail) > 0:
+		output = fmt.Sprintf("%s: %s", n.detail, n.state)
+	case !n.field && len(n.detail) > 0:
+		output += fmt.Sprintf(" (%s)", n.detail)
+	}
+	if len(n.previous) > 0 {
+		output += fmt.Sprintf(" (was %s)", n.previous)
+	}
+	if len(n.device) > 0 {
+		output = fmt.Sprintf("[%s] %s", n.device, output)
+	}
+	return output
+}
+
+// webhookSink posts a JSON message to the webhook_urls when one of the webhook_events occurs or one of the
+// webhook_fields changes, e.g. when the boiler reports a fault. The body is made from webhook_template and
+// signed with HMAC-SHA256 when webhook_secret is set.
+type webhookSink struct {
+	name            string
+	urls            []string
+	client          *http.Client
+	template        string
+	secret          string
+	signatureHeader string
+	headers         map[string]string
+	fields          map[string]bool
+	events          map[string][]string // states to post by event name, none for all states
+	values          map[string]string   // last value of every field and state of every event by device
+	posts           int                 // successful posts, see sinkBatcher
+}
+
+func newWebhookSink(name string) (sink, error) {
+	tlsConfig, err := buildTLSConfig(sinkSetting(name, "webhook_tls_ca"), sinkSetting(name, "webhook_tls_cert"),
+		sinkSetting(name, "webhook_tls_key"), strings.Contains(sinkSetting(name, "webhook_tls_insecure"), "YES"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &webhookSink{
+		name: name,
+		client: &http.Client{
+			Timeout:   time.Duration(sinkSettingInt(name, "webhook_timeout", 10)) * time.Second,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+		},
+		template:        sinkSetting(name, "webhook_template"),
+		secret:          sinkSetting(name, "webhook_secret"),
+		signatureHeader: sinkSetting(name, "webhook_signature_header"),
+		headers:         make(map[string]string),
+		fields:          make(map[string]bool),
+		events:          make(map[string][]string),
+		values:          make(map[string]string),
+	}
+	s.urls = settingList(sinkSetting(name, "webhook_urls"))
+	if len(s.urls) == 0 {
+		return nil, errors.New("webhook_urls is not set")
+	}
+	if len(s.template) == 0 {
+		s.template = webhookDefaultTemplate
+	}
+	if len(s.signatureHeader) == 0 {
+		s.signatureHeader = "X-Otgw2db-Signature"
+	}
+	for _, header := range strings.Split(sinkSetting(name, "webhook_headers"), ",") {
+		if kv := strings.SplitN(header, "=", 2); len(kv) == 2 {
+			s.headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+
+	for _, field := range settingList(settingOrDefault(name, "webhook_fields", webhookDefaultFields)) {
+		s.fields[field] = true
+	}
+	for _, event := range settingList(settingOrDefault(name, "webhook_events", "connection:disconnected, thermostat_silent, boiler_silent")) {
+		parts := strings.SplitN(event, ":", 2)
+		s.events[parts[0]] = s.events[parts[0]] // an event without a state posts all states
+		if len(parts) == 2 {
+			s.events[parts[0]] = append(s.events[parts[0]], parts[1])
+		}
+	}
+
+	example := s.body(webhookNotification{device: "home", event: "fault_indication", state: "1", previous: "0", detail: "Fault \"indication\"", field: true, time: time.Now()})
+	if !json.Valid(example) {
+		return nil, fmt.Errorf("webhook_template is not valid JSON: %s", example)
+	}
+	return s, nil
+}
+
+// settingOrDefault returns sinkSetting or def when the setting is missing, an empty setting stays empty
+func settingOrDefault(name string, key string, def string) string {
+	if val, ok := config[name+"."+key]; ok {
+		return val
+	}
+	if val, ok := config[key]; ok {
+		return val
+	}
+	return def
+}
+
+// settingList splits a comma separated setting and leaves out empty items
+func settingList(setting string) []string {
+	var list []string
+	for _, item := range strings.Split(setting, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (s *webhookSink) selectField(device string, field string) bool {
+	return s.fields[field]
+}
+
+// selectEvent selects all states of the configured events, so writeEvent sees every transition
+func (s *webhookSink) selectEvent(e otgwEvent) bool {
+	_, ok := s.events[e.name]
+	return ok
+}
+
+// writePoint posts the fields which changed. The first value of a field is posted when it is not 0,
+// so a fault which is already active when otgw2db starts is reported too.
+func (s *webhookSink) writePoint(p otgwPoint) error {
+	var err error
+	for _, f := range p.fields {
+		key := p.device + "/" + f.name
+		previous, seen := s.values[key]
+		s.values[key] = f.value
+		if previous == f.value || (!seen && f.value == "0") {
+			continue
+		}
+		detail := strings.TrimSpace(strings.SplitN(fieldName(f.readable), "[", 2)[0]) // without the [off, on] states of flags
+		n := webhookNotification{device: p.device, event: f.name, state: f.value, previous: previous, detail: detail, field: true, time: p.time}
+		if perr := s.post(n); perr != nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// writeEvent posts the events which change the state, e.g. a gateway which stays disconnected reports
+// this after every attempt to connect but is only posted once. The connecting state that is published
+// before every attempt is not a change of the connection, it is only posted when it is listed in
+// webhook_events and is not remembered as the last state.
+func (s *webhookSink) writeEvent(e otgwEvent) error {
+	key := e.device + "/event/" + e.name
+	previous := s.values[key]
+	if e.name == "connection" && e.state == connStateConnecting {
+		if !slices.Contains(s.events[e.name], e.state) {
+			return nil
+		}
+		return s.post(webhookNotification{device: e.device, event: e.name, state: e.state, previous: previous, detail: e.detail, time: e.time})
+	}
+	s.values[key] = e.state
+	if previous == e.state {
+		return nil
+	}
+	if states := s.events[e.name]; len(states) > 0 && !slices.Contains(states, e.state) {
+		return nil
+	}
+	return s.post(webhookNotification{device: e.device, event: e.name, state: e.state, previous: previous, detail: e.detail, time: e.time})
+}
+
+func (s *webhookSink) close() error {
+	return nil
+}
+
+// body fills in the template, the values are escaped for use in a JSON string
+func (s *webhookSink) body(n webhookNotification) []byte {
+	escape := func(value string) string {
+		b, _ := json.Marshal(value)
+		return string(b[1 : len(b)-1])
+	}
+	return []byte(strings.NewReplacer(
+		"{device}", escape(n.device),
+		"{event}", escape(n.event),
+		"{state}", escape(n.state),
+		"{previous}", escape(n.previous),
+		"{detail}", escape(n.detail),
+		"{time}", n.time.Format(time.RFC3339),
+		"{message}", escape(n.message()),
+	).Replace(s.template))
+}
+
+// post sends the notification to every url, a failed request is retried up to webhook_retries times
+func (s *webhookSink) post(n webhookNotification) error {
+	body := s.body(n)
+	var errs []string
+	for _, url := range s.urls {
+		if err := s.postWithRetries(url, body); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not post %s %s: %s", n.event, n.state, strings.Join(errs, ", "))
+	}
+	logVerbose.Printf("Posted %s to %d webhooks\n", n.message(), len(s.urls))
+	s.posts++
+	return nil
+}
+
+func (s *webhookSink) sent() int {
+	return s.posts
+}
+
+func (s *webhookSink) postWithRetries(url string, body []byte) error {
+	retries := sinkSettingInt(s.name, "webhook_retries", 3)
+	maxDelay := time.Duration(sinkSettingInt(s.name, "webhook_retry_max_delay", 60)) * time.Second
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := s.request(url, body)
+		if err == nil {
+			return nil
+		}
+		if retryAfter < 0 || attempt >= retries {
+			return err
+		}
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		logVerbose.Printf("Webhook %s failed, retrying in %v: %v\n", url, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// request posts the body once. When it fails the returned duration is the delay requested by the
+// server, or -1 when the request must not be retried.
+func (s *webhookSink) request(url string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "otgw2db/"+sha1ver)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if len(s.secret) > 0 {
+		mac := hmac.New(sha256.New, []byte(s.secret))
+		mac.Write(body)
+		req.Header.Set(s.signatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("status %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return parseRetryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return -1, err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSink(t *testing.T) {
+
+	failures := 1 // the first request fails and is retried
+	var messages []map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Otgw2db-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) || r.Header.Get("Priority") != "high" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		message := make(map[string]string)
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Errorf("webhook failed: invalid body %s", body)
+		}
+		messages = append(messages, message)
+	}))
+	defer server.Close()
+
+	readConfig("otgw2db.testing.cfg")
+	config["webhook_urls"] = server.URL
+	config["webhook_secret"] = "secret"
+	config["webhook_headers"] = "Priority=high"
+	config["webhook_template"] = `{"title": "{event}", "message": "{message}", "time": "{time}"}`
+
+	s, err := newWebhookSink("webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := s.(sinkSelector)
+	if !selector.selectField("home", "fault_indication") || selector.selectField("home", "boiler_water_temp") {
+		t.Errorf("webhook failed: expected only the fault fields to be selected")
+	}
+
+	ot := openthermMessage{device: "home"}
+	for _, msg := range []string{"B40000200", "B40000201", "B40000201", "B40000200"} {
+		ot.ParseMessage(msg)
+		point, _ := ot.DecodeToPoint()
+		point = point.selectFields(func(field string) bool { return selector.selectField(point.device, field) })
+		if err := s.writePoint(point); err != nil {
+			t.Errorf("webhook failed: %v", err)
+		}
+	}
+	// the states readMessagesFromOTGW publishes for a connection that is lost, fails to reconnect three
+	// times, comes back and is lost again: only the transitions to disconnected are posted
+	states := []string{connStateConnecting, connStateConnected, connStateDisconnected}
+	for i := 0; i < 3; i++ {
+		states = append(states, connStateConnecting, connStateDisconnected)
+	}
+	states = append(states, connStateConnecting, connStateConnected, connStateDisconnected, connStateConnecting, connStateDisconnected)
+	for _, state := range states {
+		e := otgwEvent{device: "home", name: "connection", state: state, detail: "connection refused", time: time.Now()}
+		if selector.selectEvent(e) {
+			s.writeEvent(e)
+		}
+	}
+
+	expected := []string{
+		"[home] Fault indication: 1 (was 0)",
+		"[home] Fault indication: 0 (was 1)",
+		"[home] connection: disconnected (connection refused) (was connected)",
+		"[home] connection: disconnected (connection refused) (was connected)",
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("webhook failed: expected %d messages, got %v", len(expected), messages)
+	}
+	for i, message := range expected {
+		if messages[i]["message"] != message {
+			t.Errorf("webhook failed: expected %s, got %s", message, messages[i]["message"])
+		}
+	}
+
+	config["webhook_template"] = `{"message": {message}}`
+	if _, err := newWebhookSink("webhook"); err == nil {
+		t.Errorf("webhook failed: expected an error for a template which is not valid JSON")
+	}
+}